@@ -1,8 +1,11 @@
 package benches
 
 import (
+	"bytes"
+	"fmt"
 	"io/ioutil"
 	"os"
+	"strings"
 	"testing"
 
 	logparser "github.com/mornyx/landing-log-parser"
@@ -15,6 +18,7 @@ func BenchmarkStreamParser(b *testing.B) {
 	if err != nil {
 		panic(err)
 	}
+	b.ReportAllocs()
 	b.ResetTimer()
 	for n := 0; n < b.N; n++ {
 		_, err := logparser.ParseFromBytes(content)
@@ -24,6 +28,22 @@ func BenchmarkStreamParser(b *testing.B) {
 	}
 }
 
+func BenchmarkStreamParserSized(b *testing.B) {
+	content, err := ioutil.ReadFile("bench_100k.log")
+	if err != nil {
+		panic(err)
+	}
+	hint := bytes.Count(content, []byte{'\n'}) + 1
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		_, err := logparser.ParseFromReaderSized(bytes.NewReader(content), hint)
+		if err != nil {
+			panic(err)
+		}
+	}
+}
+
 func BenchmarkStreamParserWithIO(b *testing.B) {
 	for n := 0; n < b.N; n++ {
 		b.StopTimer()
@@ -48,3 +68,181 @@ func BenchmarkStreamParserWithIO(b *testing.B) {
 		}
 	}
 }
+
+const tinyLog = `[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] ["Welcome to TiKV"] [region_id=1]
+`
+
+func BenchmarkFreshParserTiny(b *testing.B) {
+	b.ReportAllocs()
+	for n := 0; n < b.N; n++ {
+		parser := logparser.NewStreamParser(strings.NewReader(tinyLog))
+		if _, err := parser.ParseNext(); err != nil {
+			panic(err)
+		}
+	}
+}
+
+func BenchmarkParserPoolTiny(b *testing.B) {
+	b.ReportAllocs()
+	pool := logparser.NewParserPool()
+	for n := 0; n < b.N; n++ {
+		parser := pool.Get(strings.NewReader(tinyLog))
+		if _, err := parser.ParseNext(); err != nil {
+			panic(err)
+		}
+		pool.Put(parser)
+	}
+}
+
+func BenchmarkParseEmpty(b *testing.B) {
+	for _, c := range []struct {
+		name string
+		log  string
+	}{
+		{"Empty", ""},
+		{"BlankLines", "\n\r\n\n"},
+	} {
+		b.Run(c.name, func(b *testing.B) {
+			var r strings.Reader
+			parser := logparser.NewStreamParser(&r)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for n := 0; n < b.N; n++ {
+				r.Reset(c.log)
+				parser.Reset(&r)
+				entry, err := parser.ParseNext()
+				if entry != nil || err != nil {
+					panic(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkStreamParserLineBuffer(b *testing.B) {
+	content, err := ioutil.ReadFile("bench_100k.log")
+	if err != nil {
+		panic(err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		parser := logparser.NewStreamParser(bytes.NewReader(content), logparser.WithLineBuffer(true))
+		for {
+			entry, err := parser.ParseNext()
+			if err != nil {
+				panic(err)
+			}
+			if entry == nil {
+				break
+			}
+		}
+	}
+}
+
+func BenchmarkStreamParserParseInto(b *testing.B) {
+	content, err := ioutil.ReadFile("bench_100k.log")
+	if err != nil {
+		panic(err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		parser := logparser.NewStreamParser(bytes.NewReader(content))
+		var entry logparser.LogEntry
+		for {
+			ok, err := parser.ParseInto(&entry)
+			if err != nil {
+				panic(err)
+			}
+			if !ok {
+				break
+			}
+		}
+	}
+}
+
+func BenchmarkValidate(b *testing.B) {
+	content, err := ioutil.ReadFile("bench_100k.log")
+	if err != nil {
+		panic(err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		if err := logparser.Validate(bytes.NewReader(content), logparser.WithLineBuffer(true)); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// largeEntryLog returns n entries, each with a 64 KiB quoted field value,
+// like a big backtrace.
+func largeEntryLog(n int) []byte {
+	value := strings.Repeat("stack frame ", 64<<10/12)
+	var buf bytes.Buffer
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(&buf, "[2021/08/04 12:00:43.128 +08:00] [ERROR] [lib.rs:81] [\"panic\"] [backtrace=%q]\n", value)
+	}
+	return buf.Bytes()
+}
+
+func BenchmarkStreamParserBufferSize(b *testing.B) {
+	content := largeEntryLog(64)
+	for _, size := range []int{4 << 10, 16 << 10, 64 << 10, 256 << 10} {
+		b.Run(fmt.Sprintf("%dKiB", size>>10), func(b *testing.B) {
+			b.SetBytes(int64(len(content)))
+			for n := 0; n < b.N; n++ {
+				parser := logparser.NewStreamParser(bytes.NewReader(content), logparser.WithBufferSize(size))
+				for {
+					entry, err := parser.ParseNext()
+					if err != nil {
+						panic(err)
+					}
+					if entry == nil {
+						break
+					}
+				}
+			}
+		})
+	}
+}
+
+// nestedFieldLog returns about size bytes of entries, each with fields whose
+// values are nested depth times, like `[f={a:{a:{a:1}}}]`.
+func nestedFieldLog(size, depth int) []byte {
+	value := strings.Repeat("{a:", depth) + "1" + strings.Repeat("}", depth)
+	var buf bytes.Buffer
+	for buf.Len() < size {
+		fmt.Fprintf(&buf, "[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] [msg] [f=%s] [g=%s]\n", value, value)
+	}
+	return buf.Bytes()
+}
+
+// BenchmarkNestedFields parses the same amount of bytes with deeper and
+// deeper nested values, so the time and allocations per byte should stay
+// flat as the depth grows.
+func BenchmarkNestedFields(b *testing.B) {
+	for _, depth := range []int{1, 64, 4096, 65536} {
+		content := nestedFieldLog(1<<20, depth)
+		for _, lineBuffer := range []bool{false, true} {
+			b.Run(fmt.Sprintf("Depth%d/LineBuffer=%v", depth, lineBuffer), func(b *testing.B) {
+				b.SetBytes(int64(len(content)))
+				b.ReportAllocs()
+				for n := 0; n < b.N; n++ {
+					parser := logparser.NewStreamParser(bytes.NewReader(content), logparser.WithLineBuffer(lineBuffer))
+					var entry logparser.LogEntry
+					for {
+						ok, err := parser.ParseInto(&entry)
+						if err != nil {
+							panic(err)
+						}
+						if !ok {
+							break
+						}
+					}
+				}
+			})
+		}
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"encoding/json"
+	"flag"
 	"fmt"
 	"os"
 
@@ -9,7 +10,27 @@ import (
 )
 
 func main() {
+	level := flag.String("level", "", "only print entries at or above this level, e.g. WARN")
+	pretty := flag.Bool("pretty", false, "print indented JSON")
+	flag.Parse()
+
+	threshold := logparser.LogLevelDebug
+	if *level != "" {
+		l, err := logparser.StringToLogLevel(*level)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		threshold = l
+	}
+
 	parser := logparser.NewStreamParser(os.Stdin)
+	if threshold == logparser.LogLevelDebug && !*pretty {
+		if err := parser.WriteJSONL(os.Stdout); err != nil {
+			panic(err)
+		}
+		return
+	}
 	for {
 		entry, err := parser.ParseNext()
 		if err != nil {
@@ -18,7 +39,15 @@ func main() {
 		if entry == nil {
 			break
 		}
-		b, _ := json.Marshal(entry)
+		if entry.Header.Level < threshold {
+			continue
+		}
+		var b []byte
+		if *pretty {
+			b, _ = json.MarshalIndent(entry, "", "  ")
+		} else {
+			b, _ = json.Marshal(entry)
+		}
 		fmt.Println(string(b))
 	}
 }
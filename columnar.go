@@ -0,0 +1,101 @@
+package logparser
+
+import (
+	"io"
+	"sort"
+	"time"
+)
+
+// ColumnarBatch stores log entries in a columnar layout, for vectorized
+// processing. The header and the message of the i-th entry are the i-th
+// elements of the parallel slices, while the fields are stored in sparse
+// columns keyed by the field name. The zero value is an empty batch ready
+// to use.
+type ColumnarBatch struct {
+	Times    []time.Time
+	Levels   []LogLevel
+	Files    []string
+	Lines    []int
+	Messages []string
+	// Fields maps a field name to its column.
+	Fields map[string]*FieldColumn
+}
+
+// FieldColumn is the sparse column of a field in a ColumnarBatch.
+// Values[i] belongs to the entry with index Rows[i]. Rows are in ascending
+// order, and an index appears more than once if the entry has the field more
+// than once.
+type FieldColumn struct {
+	Rows   []int
+	Values []string
+}
+
+// Len returns the number of entries in b.
+func (b *ColumnarBatch) Len() int {
+	return len(b.Times)
+}
+
+// AppendEntry appends e as the last row of b.
+func (b *ColumnarBatch) AppendEntry(e *LogEntry) {
+	row := len(b.Times)
+	b.Times = append(b.Times, e.Header.DateTime)
+	b.Levels = append(b.Levels, e.Header.Level)
+	b.Files = append(b.Files, e.Header.File)
+	b.Lines = append(b.Lines, e.Header.Line)
+	b.Messages = append(b.Messages, e.Message)
+	for _, f := range e.Fields {
+		if b.Fields == nil {
+			b.Fields = make(map[string]*FieldColumn)
+		}
+		col, ok := b.Fields[f.Name]
+		if !ok {
+			col = &FieldColumn{}
+			b.Fields[f.Name] = col
+		}
+		col.Rows = append(col.Rows, row)
+		col.Values = append(col.Values, f.Value)
+	}
+}
+
+// FieldNames returns the names of the field columns of b, sorted.
+func (b *ColumnarBatch) FieldNames() []string {
+	names := make([]string, 0, len(b.Fields))
+	for name := range b.Fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Value returns the first value of the field name of the entry at row, and
+// whether the entry has the field.
+func (b *ColumnarBatch) Value(row int, name string) (string, bool) {
+	col, ok := b.Fields[name]
+	if !ok {
+		return "", false
+	}
+	i := sort.SearchInts(col.Rows, row)
+	if i == len(col.Rows) || col.Rows[i] != row {
+		return "", false
+	}
+	return col.Values[i], true
+}
+
+// ParseColumnar parses a byte stream from io.Reader like ParseFromReader,
+// and returns the entries as a ColumnarBatch.
+func ParseColumnar(r io.Reader, opts ...Option) (*ColumnarBatch, error) {
+	b := &ColumnarBatch{}
+	p := NewStreamParser(r, opts...)
+	var e LogEntry
+	for {
+		ok, err := p.ParseInto(&e)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			break
+		}
+		b.AppendEntry(&e)
+	}
+	return b, nil
+}
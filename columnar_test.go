@@ -0,0 +1,50 @@
+package logparser
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseColumnar(t *testing.T) {
+	log := `[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] [first] [region_id=4] [peer=a]
+[2021/08/04 12:00:44.128 +08:00] [WARN] [lib.rs:82] [second]
+[2021/08/04 12:00:45.128 +08:00] [ERROR] [main.go:7] [third] [peer=b] [region_id=5] [peer=c]`
+	b, err := ParseColumnar(strings.NewReader(log))
+	assert.NoError(t, err)
+	assert.Equal(t, 3, b.Len())
+	assert.True(t, b.Times[1].Equal(time.Date(2021, 8, 4, 4, 0, 44, 128*1000*1000, time.UTC)))
+	assert.Equal(t, []LogLevel{LogLevelInfo, LogLevelWarn, LogLevelError}, b.Levels)
+	assert.Equal(t, []string{"lib.rs", "lib.rs", "main.go"}, b.Files)
+	assert.Equal(t, []int{81, 82, 7}, b.Lines)
+	assert.Equal(t, []string{"first", "second", "third"}, b.Messages)
+	assert.Equal(t, []string{"peer", "region_id"}, b.FieldNames())
+	assert.Equal(t, &FieldColumn{Rows: []int{0, 2}, Values: []string{"4", "5"}}, b.Fields["region_id"])
+	assert.Equal(t, &FieldColumn{Rows: []int{0, 2, 2}, Values: []string{"a", "b", "c"}}, b.Fields["peer"])
+
+	v, ok := b.Value(2, "peer")
+	assert.True(t, ok)
+	assert.Equal(t, "b", v)
+	_, ok = b.Value(1, "peer")
+	assert.False(t, ok)
+	_, ok = b.Value(0, "missing")
+	assert.False(t, ok)
+
+	_, err = ParseColumnar(strings.NewReader(log + "\n[2021/08/04 12:00:45.128 +08:00] [ERROR] [main.go:x] [fourth]"))
+	assert.Error(t, err)
+}
+
+func TestColumnarBatch_AppendEntry(t *testing.T) {
+	var b ColumnarBatch
+	assert.Equal(t, 0, b.Len())
+	assert.Empty(t, b.FieldNames())
+	b.AppendEntry(&LogEntry{Message: "m"})
+	assert.Equal(t, 1, b.Len())
+	assert.Nil(t, b.Fields)
+	b.AppendEntry(&LogEntry{Fields: []LogField{{Name: "k", Value: "v"}}})
+	v, ok := b.Value(1, "k")
+	assert.True(t, ok)
+	assert.Equal(t, "v", v)
+}
@@ -0,0 +1,150 @@
+package logparser
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// datetimeLayoutNoZone is the part of datetimeLayout without the zone.
+const datetimeLayoutNoZone = "2006/01/02 15:04:05.000"
+
+// datetimeFractionPos is the position of the '.' before the fractional
+// seconds in datetimeLayout.
+const datetimeFractionPos = len("2006/01/02 15:04:05")
+
+// parseDatetimeToken parses the text between the brackets of the datetime.
+// The token must not escape, except as a copy made by cloneToken, so that
+// the caller can convert the datetime buffer to it without allocation.
+func (p *StreamParser) parseDatetimeToken(token string) (time.Time, error) {
+	if p.datetimeParser != nil {
+		return p.datetimeParser(cloneToken(token))
+	}
+	if p.epochUnit > 0 {
+		return p.parseEpochDatetime(token)
+	}
+	if err := checkDatetimeYear(token); err != nil {
+		return time.Time{}, err
+	}
+	if p.strictDatetime {
+		if err := checkDatetimeComponents(token); err != nil {
+			return time.Time{}, err
+		}
+	}
+	var t time.Time
+	var err error
+	noZone := len(token) == len(datetimeLayoutNoZone)
+	if noZone && (p.location != nil || p.defaultLocation != nil) {
+		// The datetime ends right after the fractional seconds, without zone.
+		loc := p.location
+		if loc == nil {
+			loc = p.defaultLocation
+		}
+		t, err = time.ParseInLocation(datetimeLayoutNoZone, token, loc)
+	} else {
+		t, err = time.Parse(datetimeLayout, token)
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	if p.strictDatetime {
+		// Formatting needs some room to spare, like in time.Time.Format.
+		var buf [64]byte
+		if f := t.AppendFormat(buf[:0], datetimeLayoutNoZone); !strings.HasPrefix(token, string(f)) {
+			return time.Time{}, fmt.Errorf("datetime '%s' is normalized to '%s'", cloneToken(token), string(f))
+		}
+	}
+	if p.location != nil {
+		return t.In(p.location), nil
+	}
+	// Both "Z" and a zero offset like "+00:00" mean UTC, if the zone is
+	// in the token rather than the default location.
+	if _, offset := t.Zone(); offset == 0 && !noZone {
+		t = t.UTC()
+	}
+	return t, nil
+}
+
+// parseEpochDatetime parses a datetime token which is an integer number of
+// epochUnit since the Unix epoch.
+func (p *StreamParser) parseEpochDatetime(token string) (time.Time, error) {
+	v, err := strconv.ParseInt(token, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid epoch datetime '%s'", cloneToken(token))
+	}
+	var t time.Time
+	if p.epochUnit >= time.Second {
+		t = time.Unix(v*int64(p.epochUnit/time.Second), 0)
+	} else {
+		perSecond := int64(time.Second / p.epochUnit)
+		t = time.Unix(v/perSecond, v%perSecond*int64(p.epochUnit))
+	}
+	if p.location != nil {
+		return t.In(p.location), nil
+	}
+	return t.UTC(), nil
+}
+
+// checkDatetimeYear checks that a datetime in the default layout starts
+// with a positive four-digit year, to reject garbage like `-001/08/04`
+// early with a clear error.
+func checkDatetimeYear(s string) error {
+	if len(s) < 5 || s[4] != '/' || s[:4] == "0000" {
+		return fmt.Errorf("invalid year in datetime '%s'", cloneToken(s))
+	}
+	for i := 0; i < 4; i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return fmt.Errorf("invalid year in datetime '%s'", cloneToken(s))
+		}
+	}
+	return nil
+}
+
+// checkDatetimeComponents checks that every component of a datetime in the
+// default layout is in its valid range, so that nothing would be normalized.
+// The offending component is named in the returned error.
+func checkDatetimeComponents(s string) error {
+	if len(s) < len(datetimeLayoutNoZone) {
+		return fmt.Errorf("datetime '%s' is too short", cloneToken(s))
+	}
+	component := func(name string, from, to, min, max int) (int, error) {
+		v, err := strconv.Atoi(s[from:to])
+		if err != nil {
+			return 0, fmt.Errorf("invalid %s '%s' in datetime", name, cloneToken(s[from:to]))
+		}
+		if v < min || v > max {
+			return 0, fmt.Errorf("%s %d out of range [%d, %d] in datetime", name, v, min, max)
+		}
+		return v, nil
+	}
+	year, err := component("year", 0, 4, 0, 9999)
+	if err != nil {
+		return err
+	}
+	month, err := component("month", 5, 7, 1, 12)
+	if err != nil {
+		return err
+	}
+	// Day 0 of the next month is the last day of this month.
+	days := time.Date(year, time.Month(month)+1, 0, 0, 0, 0, 0, time.UTC).Day()
+	if _, err := component("day", 8, 10, 1, days); err != nil {
+		return err
+	}
+	if _, err := component("hour", 11, 13, 0, 23); err != nil {
+		return err
+	}
+	if _, err := component("minute", 14, 16, 0, 59); err != nil {
+		return err
+	}
+	if _, err := component("second", 17, 19, 0, 59); err != nil {
+		return err
+	}
+	return nil
+}
+
+// cloneToken returns a copy of a datetime token which may be kept, e.g. by an
+// error, since the token itself may point to a temporary buffer.
+func cloneToken(s string) string {
+	return string([]byte(s))
+}
@@ -0,0 +1,200 @@
+package logparser
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+	_ "time/tzdata"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckDatetimeComponents(t *testing.T) {
+	assert.NoError(t, checkDatetimeComponents("2021/08/04 12:00:43.128 +08:00"))
+	assert.NoError(t, checkDatetimeComponents("2020/02/29 23:59:59.999 Z"))
+	assert.EqualError(t, checkDatetimeComponents("2021/13/01 12:00:43.128 +08:00"), "month 13 out of range [1, 12] in datetime")
+	assert.EqualError(t, checkDatetimeComponents("2021/02/30 12:00:43.128 +08:00"), "day 30 out of range [1, 28] in datetime")
+	assert.EqualError(t, checkDatetimeComponents("2021/02/29 12:00:43.128 +08:00"), "day 29 out of range [1, 28] in datetime")
+	assert.EqualError(t, checkDatetimeComponents("2021/02/01 24:00:43.128 +08:00"), "hour 24 out of range [0, 23] in datetime")
+	assert.EqualError(t, checkDatetimeComponents("2021/02/01 12:60:43.128 +08:00"), "minute 60 out of range [0, 59] in datetime")
+	assert.EqualError(t, checkDatetimeComponents("2021/02/01 12:00:60.128 +08:00"), "second 60 out of range [0, 59] in datetime")
+	assert.EqualError(t, checkDatetimeComponents("2021/0x/01 12:00:43.128 +08:00"), "invalid month '0x' in datetime")
+	assert.Error(t, checkDatetimeComponents("2021/02/01"))
+}
+
+func TestCheckDatetimeYear(t *testing.T) {
+	for _, token := range []string{"-001/08/04 12:00:43.128 +08:00", "0000/08/04 12:00:43.128 +08:00", "21/08/04 12:00:43.128 +08:00", "+2021/08/04 12:00:43.128 +08:00", "2021"} {
+		parser := NewStreamParser(strings.NewReader("[" + token + "]"))
+		_, err := parser.parseDatetime()
+		assert.Error(t, err, token)
+		assert.Contains(t, err.Error(), "invalid year in datetime", token)
+	}
+	assert.NoError(t, checkDatetimeYear("0001/01/01 00:00:00.000 Z"))
+}
+
+func TestWithStrictDatetime(t *testing.T) {
+	parser := NewStreamParser(strings.NewReader("[2021/08/04 12:00:43.128 +08:00]"), WithStrictDatetime(true))
+	_, err := parser.parseDatetime()
+	assert.NoError(t, err)
+	parser = NewStreamParser(strings.NewReader("[2021/08/04 12:00:43.128 +00:00]"), WithStrictDatetime(true))
+	_, err = parser.parseDatetime()
+	assert.NoError(t, err)
+	parser = NewStreamParser(strings.NewReader("[2021/13/01 12:00:43.128 +08:00]"), WithStrictDatetime(true))
+	_, err = parser.parseDatetime()
+	assert.EqualError(t, err, "month 13 out of range [1, 12] in datetime")
+	parser = NewStreamParser(strings.NewReader("[2021/02/30 12:00:43.128 +08:00]"), WithStrictDatetime(true))
+	_, err = parser.parseDatetime()
+	assert.EqualError(t, err, "day 30 out of range [1, 28] in datetime")
+}
+
+func TestWithLocation(t *testing.T) {
+	shanghai, err := time.LoadLocation("Asia/Shanghai")
+	assert.NoError(t, err)
+	parser := NewStreamParser(strings.NewReader("[2021/08/04 12:00:43.128][2021/08/04 04:00:43.128 Z]"), WithLocation(shanghai))
+	for i := 0; i < 2; i++ {
+		datetime, err := parser.parseDatetime()
+		assert.NoError(t, err)
+		assert.Equal(t, shanghai, datetime.Location())
+		assert.Equal(t, 12, datetime.Hour())
+		assert.True(t, datetime.Equal(time.Date(2021, 8, 4, 4, 0, 43, 128*1000*1000, time.UTC)))
+	}
+	parser = NewStreamParser(strings.NewReader("[2021/08/04 12:00:43.128]"))
+	_, err = parser.parseDatetime()
+	assert.Error(t, err)
+}
+
+func TestWithDefaultLocation(t *testing.T) {
+	shanghai, err := time.LoadLocation("Asia/Shanghai")
+	assert.NoError(t, err)
+	parser := NewStreamParser(strings.NewReader("[2021/08/04 12:00:43.128][2021/08/04 04:00:43.128 Z][2021/08/04 12:00:43.128 +09:00]"), WithDefaultLocation(shanghai))
+	datetime, err := parser.parseDatetime()
+	assert.NoError(t, err)
+	assert.Equal(t, shanghai, datetime.Location())
+	assert.True(t, datetime.Equal(time.Date(2021, 8, 4, 4, 0, 43, 128*1000*1000, time.UTC)))
+	datetime, err = parser.parseDatetime()
+	assert.NoError(t, err)
+	assert.Equal(t, time.UTC, datetime.Location())
+	assert.Equal(t, 4, datetime.Hour())
+	datetime, err = parser.parseDatetime()
+	assert.NoError(t, err)
+	_, offset := datetime.Zone()
+	assert.Equal(t, 9*60*60, offset)
+	assert.Equal(t, 12, datetime.Hour())
+
+	// A default location with a zero offset is kept, unlike a zone in the
+	// token.
+	london, err := time.LoadLocation("Europe/London")
+	assert.NoError(t, err)
+	parser = NewStreamParser(strings.NewReader("[2021/01/04 12:00:43.128][2021/01/04 12:00:43.128 +00:00]"), WithDefaultLocation(london))
+	datetime, err = parser.parseDatetime()
+	assert.NoError(t, err)
+	assert.Equal(t, london, datetime.Location())
+	assert.Equal(t, 12, datetime.Hour())
+	datetime, err = parser.parseDatetime()
+	assert.NoError(t, err)
+	assert.Equal(t, time.UTC, datetime.Location())
+
+	// WithLocation takes precedence.
+	parser = NewStreamParser(strings.NewReader("[2021/08/04 12:00:43.128]"), WithDefaultLocation(shanghai), WithLocation(time.UTC))
+	datetime, err = parser.parseDatetime()
+	assert.NoError(t, err)
+	assert.Equal(t, time.Date(2021, 8, 4, 12, 0, 43, 128*1000*1000, time.UTC), datetime)
+}
+
+func TestWithEpochDatetime(t *testing.T) {
+	expect := time.Date(2021, 8, 4, 4, 0, 43, 128000000, time.UTC)
+	for _, c := range []struct {
+		token string
+		unit  time.Duration
+		t     time.Time
+	}{
+		{"1628049643128", time.Millisecond, expect},
+		{"1628049643128456", time.Microsecond, expect.Add(456 * time.Microsecond)},
+		{"1628049643128456789", time.Nanosecond, expect.Add(456789 * time.Nanosecond)},
+		{"1628049643", time.Second, expect.Truncate(time.Second)},
+		{"0", time.Millisecond, time.Unix(0, 0).UTC()},
+	} {
+		entries, err := ParseFromString("["+c.token+"] [INFO] [lib.rs:81] [msg]", WithEpochDatetime(c.unit))
+		assert.NoError(t, err, c.token)
+		assert.Equal(t, c.t, entries[0].Header.DateTime, c.token)
+	}
+
+	loc, err := time.LoadLocation("Asia/Shanghai")
+	assert.NoError(t, err)
+	entries, err := ParseFromString("[1628049643128] [INFO] [lib.rs:81] [msg]", WithEpochDatetime(time.Millisecond), WithLocation(loc))
+	assert.NoError(t, err)
+	assert.Equal(t, "2021/08/04 12:00:43.128 +08:00", entries[0].Header.DateTime.Format(datetimeLayout))
+
+	for _, token := range []string{"2021/08/04 12:00:43.128 +08:00", "", "99999999999999999999"} {
+		_, err := ParseFromString("["+token+"] [INFO] [lib.rs:81] [msg]", WithEpochDatetime(time.Millisecond))
+		assert.Error(t, err, token)
+	}
+}
+
+func TestParseDatetimeLong(t *testing.T) {
+	// Longer than the default layout.
+	token := strings.Repeat("0", 40) + "1628049643128"
+	entries, err := ParseFromString("["+token+"] [INFO] [lib.rs:81] [msg]", WithEpochDatetime(time.Millisecond))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1628049643128), entries[0].Header.DateTime.UnixNano()/int64(time.Millisecond))
+
+	_, err = ParseFromString("["+strings.Repeat("0", maxDatetimeLen+1)+"] [INFO] [lib.rs:81] [msg]", WithEpochDatetime(time.Millisecond))
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "datetime too long")
+}
+
+func TestWithNormalizeUTC(t *testing.T) {
+	log := `[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] [a]
+[2021/08/04 04:00:43.128 +00:00] [INFO] [lib.rs:81] [b]
+[2021/08/03 23:00:43.129 -05:00] [INFO] [lib.rs:81] [c]`
+	entries, err := ParseFromString(log, WithNormalizeUTC(true))
+	assert.NoError(t, err)
+	for i, offset := range []int{8 * 3600, 0, -5 * 3600} {
+		assert.Equal(t, time.UTC, entries[i].Header.DateTime.Location())
+		assert.Equal(t, offset, entries[i].Header.OriginalOffset)
+	}
+	assert.Equal(t, entries[0].Header.DateTime, entries[1].Header.DateTime)
+	assert.True(t, entries[1].Header.DateTime.Before(entries[2].Header.DateTime))
+
+	// The zone is kept by default.
+	entries, err = ParseFromString(log)
+	assert.NoError(t, err)
+	_, offset := entries[0].Header.DateTime.Zone()
+	assert.Equal(t, 8*3600, offset)
+	assert.Equal(t, 0, entries[0].Header.OriginalOffset)
+}
+
+func TestWithDateTimeParser(t *testing.T) {
+	months := map[string]time.Month{"Jan": time.January, "Aug": time.August}
+	parse := func(token string) (time.Time, error) {
+		// Like `04.Aug 2021 – 12h00`.
+		var day, year, hour, minute int
+		var month string
+		if _, err := fmt.Sscanf(token, "%d.%3s %d – %dh%d", &day, &month, &year, &hour, &minute); err != nil {
+			return time.Time{}, err
+		}
+		m, ok := months[month]
+		if !ok {
+			return time.Time{}, fmt.Errorf("unknown month %q", month)
+		}
+		return time.Date(year, m, day, hour, minute, 0, 0, time.UTC), nil
+	}
+	log := `[04.Aug 2021 – 12h00] [INFO] [lib.rs:81] [msg]
+[13.Jan 2022 – 00h30] [INFO] [lib.rs:81] [msg]`
+	for _, opts := range [][]Option{
+		{WithDateTimeParser(parse)},
+		{WithDateTimeParser(parse), WithLineBuffer(true)},
+	} {
+		entries, err := ParseFromString(log, opts...)
+		assert.NoError(t, err)
+		assert.Len(t, entries, 2)
+		assert.Equal(t, time.Date(2021, 8, 4, 12, 0, 0, 0, time.UTC), entries[0].Header.DateTime)
+		assert.Equal(t, time.Date(2022, 1, 13, 0, 30, 0, 0, time.UTC), entries[1].Header.DateTime)
+	}
+	_, err := ParseFromString(log)
+	assert.Error(t, err)
+	_, err = ParseFromString(`[04.Sep 2021 – 12h00] [INFO] [lib.rs:81] [msg]`, WithDateTimeParser(parse))
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), `unknown month "Sep"`)
+}
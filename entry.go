@@ -0,0 +1,305 @@
+package logparser
+
+import (
+	"bytes"
+	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Equal reports whether e and other represent the same log entry.
+// Timestamps are compared with time.Time.Equal, so the monotonic clock
+// reading and the location are ignored. Fields are compared in order. How
+// the message and values were written, quoted or not, is ignored as well.
+func (e *LogEntry) Equal(other *LogEntry) bool {
+	if e == nil || other == nil {
+		return e == other
+	}
+	return e.Header.DateTime.Equal(other.Header.DateTime) && e.EqualIgnoringTime(other)
+}
+
+// EqualIgnoringTime is like Equal but does not compare timestamps.
+func (e *LogEntry) EqualIgnoringTime(other *LogEntry) bool {
+	if e == nil || other == nil {
+		return e == other
+	}
+	if e.Header.Level != other.Header.Level ||
+		e.Header.File != other.Header.File ||
+		e.Header.Line != other.Header.Line ||
+		e.Message != other.Message ||
+		len(e.Fields) != len(other.Fields) {
+		return false
+	}
+	for i := range e.Fields {
+		if e.Fields[i].Name != other.Fields[i].Name || e.Fields[i].Value != other.Fields[i].Value {
+			return false
+		}
+	}
+	return true
+}
+
+// SortEntries sorts entries by Header.DateTime. The sort is stable, entries
+// with equal timestamps keep their original order, which is common since
+// timestamps only have millisecond resolution.
+func SortEntries(entries []*LogEntry) {
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Header.DateTime.Before(entries[j].Header.DateTime)
+	})
+}
+
+// IsSorted reports whether entries are sorted by Header.DateTime. Entries
+// with equal timestamps are considered sorted in any order.
+func IsSorted(entries []*LogEntry) bool {
+	for i := 1; i < len(entries); i++ {
+		if entries[i].Header.DateTime.Before(entries[i-1].Header.DateTime) {
+			return false
+		}
+	}
+	return true
+}
+
+// CollectFieldNames returns the names of all fields in entries, sorted and
+// without duplicates, e.g. to build the schema of a table. Nil entries are
+// skipped.
+func CollectFieldNames(entries []*LogEntry) []string {
+	seen := make(map[string]struct{})
+	names := []string{}
+	for _, e := range entries {
+		if e == nil {
+			continue
+		}
+		for _, f := range e.Fields {
+			if _, ok := seen[f.Name]; !ok {
+				seen[f.Name] = struct{}{}
+				names = append(names, f.Name)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// MergeByKey merges each run of consecutive entries with the same key into
+// one entry, e.g. with a key made of the timestamp, the level and the message
+// to merge entries which only differ in a field value. A merged entry is a
+// copy of the first entry of the run, with the fields of all entries of the
+// run, in the order the names first appear. A field whose value is the same
+// in every entry having it keeps that value. Otherwise, its value is a JSON
+// array of the values of the entries having it, in order, like `["1","2"]`.
+// Only the first field with a name in each entry is taken. An entry which
+// is not merged with others is returned as is. entries are not modified.
+func MergeByKey(entries []*LogEntry, key func(*LogEntry) string) []*LogEntry {
+	var merged []*LogEntry
+	for i := 0; i < len(entries); {
+		k := key(entries[i])
+		j := i + 1
+		for j < len(entries) && key(entries[j]) == k {
+			j++
+		}
+		if j-i == 1 {
+			merged = append(merged, entries[i])
+		} else {
+			merged = append(merged, mergeEntries(entries[i:j]))
+		}
+		i = j
+	}
+	return merged
+}
+
+// mergeEntries merges entries as described in MergeByKey.
+func mergeEntries(entries []*LogEntry) *LogEntry {
+	e := entries[0].Clone()
+	e.Fields = nil
+	var names []string
+	values := make(map[string][]LogField)
+	for _, entry := range entries {
+		for i, f := range entry.Fields {
+			if fieldIndex(entry.Fields[:i], f.Name) >= 0 {
+				continue
+			}
+			if _, ok := values[f.Name]; !ok {
+				names = append(names, f.Name)
+			}
+			values[f.Name] = append(values[f.Name], f)
+		}
+	}
+	for _, name := range names {
+		fields := values[name]
+		same := true
+		for _, f := range fields[1:] {
+			same = same && f.Value == fields[0].Value
+		}
+		if same {
+			e.Fields = append(e.Fields, fields[0])
+			continue
+		}
+		list := make([]string, len(fields))
+		for i, f := range fields {
+			list[i] = f.Value
+		}
+		e.Fields = append(e.Fields, LogField{Name: name, Value: encodeJSON(list)})
+	}
+	return e
+}
+
+// fieldIndex returns the index of the first field with the given name, or
+// -1 if there is none.
+func fieldIndex(fields []LogField, name string) int {
+	for i, f := range fields {
+		if f.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// Clone returns a deep copy of e, which does not share the Fields and
+// Continuation slices with e. Use it to retain entries parsed by ParseInto,
+// which reuses the slices of the entry it parses into.
+func (e *LogEntry) Clone() *LogEntry {
+	if e == nil {
+		return nil
+	}
+	c := *e
+	if e.Fields != nil {
+		c.Fields = append([]LogField(nil), e.Fields...)
+	}
+	if e.Continuation != nil {
+		c.Continuation = append([]string(nil), e.Continuation...)
+	}
+	return &c
+}
+
+// WithInheritedFields returns a copy of e with the fields of parent, e.g. a
+// span start entry, prepended. A parent field is left out if e has a field
+// with the same name, so the child wins. The order of the fields is kept
+// otherwise. e and parent are not modified.
+func (e *LogEntry) WithInheritedFields(parent *LogEntry) *LogEntry {
+	c := *e
+	c.Fields = nil
+	if parent != nil {
+		for _, f := range parent.Fields {
+			if !e.hasField(f.Name) {
+				c.Fields = append(c.Fields, f)
+			}
+		}
+	}
+	c.Fields = append(c.Fields, e.Fields...)
+	if e.Continuation != nil {
+		c.Continuation = append([]string(nil), e.Continuation...)
+	}
+	return &c
+}
+
+func (e *LogEntry) hasField(name string) bool {
+	_, ok := e.Field(name)
+	return ok
+}
+
+// Field returns the value of the first field with the given name, and
+// whether it exists.
+func (e *LogEntry) Field(name string) (string, bool) {
+	if i := fieldIndex(e.Fields, name); i >= 0 {
+		return e.Fields[i].Value, true
+	}
+	return "", false
+}
+
+// RegionID returns the value of the region_id field, which TiKV logs often
+// carry, as an integer. It returns false if the field is absent or is not
+// an integer.
+func (e *LogEntry) RegionID() (int64, bool) {
+	return e.intField("region_id")
+}
+
+// StoreID is like RegionID, for the store_id field.
+func (e *LogEntry) StoreID() (int64, bool) {
+	return e.intField("store_id")
+}
+
+// PeerID is like RegionID, for the peer_id field.
+func (e *LogEntry) PeerID() (int64, bool) {
+	return e.intField("peer_id")
+}
+
+func (e *LogEntry) intField(name string) (int64, bool) {
+	v, ok := e.Field(name)
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return n, true
+}
+
+// String returns e as a log line in the default layout, like
+// `[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] [msg] [k=v]`, followed
+// by its continuation lines, if any. The message, field names and values are
+// quoted as in LogField.String. An empty file is written as `<unknown>`. The
+// comment, the source and the trailer are not written, since their format is
+// not known.
+func (e *LogEntry) String() string {
+	var b strings.Builder
+	b.WriteByte('[')
+	b.WriteString(e.Header.DateTime.Format(datetimeLayout))
+	b.WriteString("] [")
+	b.WriteString(e.Header.Level.String())
+	b.WriteString("] [")
+	if e.Header.File == "" {
+		b.WriteString("<unknown>")
+	} else {
+		b.WriteString(e.Header.File)
+		b.WriteByte(':')
+		b.WriteString(strconv.Itoa(e.Header.Line))
+	}
+	b.WriteString("] [")
+	b.WriteString(quoteLiteral(e.Message))
+	b.WriteByte(']')
+	for _, f := range e.Fields {
+		b.WriteString(" [")
+		b.WriteString(f.String())
+		b.WriteByte(']')
+	}
+	for _, line := range e.Continuation {
+		b.WriteByte('\n')
+		b.WriteString(line)
+	}
+	return b.String()
+}
+
+// String returns the field as `name=value`, as it would be written inside of
+// the brackets in a log. The name and the value are quoted, if they could not
+// be parsed as bare literals.
+func (f LogField) String() string {
+	return quoteLiteral(f.Name) + "=" + quoteLiteral(f.Value)
+}
+
+// quoteLiteral returns s as a bare literal if possible, or a quoted string.
+// A bare value starting with '{' would be parsed as JSON, and a backslash
+// could escape the next character, so such literals are quoted.
+func quoteLiteral(s string) string {
+	bare := s != "" && s[0] != '{'
+	for _, c := range s {
+		if !validStringLiteralChar(c) || c == '\\' {
+			bare = false
+			break
+		}
+	}
+	if bare {
+		return s
+	}
+	return encodeJSON(s)
+}
+
+// encodeJSON returns v encoded as JSON, without escaping HTML characters.
+func encodeJSON(v interface{}) string {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	// Encoding strings never fails.
+	_ = enc.Encode(v)
+	return string(bytes.TrimSuffix(buf.Bytes(), []byte("\n")))
+}
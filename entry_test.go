@@ -0,0 +1,248 @@
+package logparser
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLogEntry_Equal(t *testing.T) {
+	entries, err := ParseFromString(`[2021/08/04 12:00:43.129 +08:00] [DEBUG] [<unknown>] [test_message] [test_k1=test_v1] ["test k2"="test v2"]
+[2021/08/04 04:00:43.129 +00:00] [DEBUG] [<unknown>] [test_message] [test_k1=test_v1] ["test k2"="test v2"]
+[2021/08/04 12:00:43.130 +08:00] [DEBUG] [<unknown>] [test_message] [test_k1=test_v1] ["test k2"="test v2"]
+[2021/08/04 12:00:43.129 +08:00] [DEBUG] [<unknown>] [test_message] ["test k2"="test v2"] [test_k1=test_v1]`)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 4)
+	assert.True(t, entries[0].Equal(entries[0]))
+	assert.True(t, entries[0].Equal(entries[1]))
+	assert.False(t, entries[0].Equal(entries[2]))
+	assert.True(t, entries[0].EqualIgnoringTime(entries[2]))
+	assert.False(t, entries[0].Equal(entries[3]))
+	assert.False(t, entries[0].EqualIgnoringTime(entries[3]))
+
+	// Quoting is ignored.
+	quoted, err := ParseFromString(`[2021/08/04 12:00:43.129 +08:00] [DEBUG] [<unknown>] ["test_message"] [test_k1="test_v1"] ["test k2"="test v2"]`)
+	assert.NoError(t, err)
+	assert.True(t, entries[0].Equal(quoted[0]))
+
+	// Monotonic clock readings are ignored.
+	now := time.Now()
+	a := &LogEntry{Header: LogHeader{DateTime: now}}
+	b := &LogEntry{Header: LogHeader{DateTime: now.Round(0)}}
+	assert.True(t, a.Equal(b))
+
+	var nilEntry *LogEntry
+	assert.True(t, nilEntry.Equal(nil))
+	assert.False(t, nilEntry.Equal(a))
+	assert.False(t, a.Equal(nil))
+	assert.False(t, a.EqualIgnoringTime(nil))
+}
+
+func TestLogEntry_JSON(t *testing.T) {
+	entries, err := ParseFromString(`[2021/08/04 12:00:43.129 +08:00] [WARN] [lib.rs:81] [test_message] [test_k1=test_v1] ["test k2"="test v2"]`)
+	assert.NoError(t, err)
+	b, err := json.Marshal(entries[0])
+	assert.NoError(t, err)
+	assert.Equal(t, `{"Header":{"DateTime":"2021-08-04T12:00:43.129+08:00","Level":"WARN","File":"lib.rs","Line":81},"Message":"test_message","Fields":[{"Name":"test_k1","Value":"test_v1"},{"Name":"test k2","Value":"test v2","ValueQuoted":true}]}`, string(b))
+	var entry LogEntry
+	assert.NoError(t, json.Unmarshal(b, &entry))
+	assert.True(t, entries[0].Equal(&entry))
+
+	var level LogLevel
+	assert.NoError(t, json.Unmarshal([]byte(`"debug"`), &level))
+	assert.Equal(t, LogLevelDebug, level)
+	assert.NoError(t, json.Unmarshal([]byte(`3`), &level))
+	assert.Equal(t, LogLevelFatal, level)
+	assert.Error(t, json.Unmarshal([]byte(`"UNKNOWN"`), &level))
+	assert.Error(t, json.Unmarshal([]byte(`{}`), &level))
+}
+
+func TestSortEntries(t *testing.T) {
+	entries, err := ParseFromString(`[2021/08/04 12:00:43.130 +08:00] [INFO] [<unknown>] [a]
+[2021/08/04 12:00:43.129 +08:00] [INFO] [<unknown>] [b]
+[2021/08/04 04:00:43.130 +00:00] [INFO] [<unknown>] [c]
+[2021/08/04 12:00:43.129 +08:00] [INFO] [<unknown>] [d]
+[2021/08/04 12:00:43.128 +08:00] [INFO] [<unknown>] [e]`)
+	assert.NoError(t, err)
+	assert.False(t, IsSorted(entries))
+	SortEntries(entries)
+	assert.True(t, IsSorted(entries))
+	var messages []string
+	for _, entry := range entries {
+		messages = append(messages, entry.Message)
+	}
+	// Equal timestamps keep their original order, regardless of the zone.
+	assert.Equal(t, []string{"e", "b", "d", "a", "c"}, messages)
+
+	assert.True(t, IsSorted(nil))
+	SortEntries(nil)
+}
+
+func TestLogEntry_WithInheritedFields(t *testing.T) {
+	entries, err := ParseFromString(`[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] [span] [trace_id=1] [region_id=2] [peer_id=3]
+[2021/08/04 12:00:43.129 +08:00] [WARN] [lib.rs:82] [child] [region_id=4] [err=timeout]
+[2021/08/04 12:00:43.129 +08:00] [WARN] [lib.rs:82] [bare]`)
+	assert.NoError(t, err)
+	parent, child, bare := entries[0], entries[1], entries[2]
+
+	merged := child.WithInheritedFields(parent)
+	assert.Equal(t, []LogField{
+		{Name: "trace_id", Value: "1"},
+		{Name: "peer_id", Value: "3"},
+		{Name: "region_id", Value: "4"},
+		{Name: "err", Value: "timeout"},
+	}, merged.Fields)
+	assert.True(t, merged.Header == child.Header)
+	assert.Equal(t, "child", merged.Message)
+	// Neither is modified.
+	assert.Len(t, parent.Fields, 3)
+	assert.Equal(t, []LogField{{Name: "region_id", Value: "4"}, {Name: "err", Value: "timeout"}}, child.Fields)
+
+	assert.Equal(t, parent.Fields, bare.WithInheritedFields(parent).Fields)
+	assert.Equal(t, child.Fields, child.WithInheritedFields(nil).Fields)
+	assert.Nil(t, bare.WithInheritedFields(bare).Fields)
+}
+
+func TestLogEntry_Clone(t *testing.T) {
+	log := `[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] [first] [a=1] [b=2]
+  backtrace
+[2021/08/04 12:00:43.129 +08:00] [WARN] [lib.rs:82] [second] [c=3]`
+	parser := NewStreamParser(strings.NewReader(log), WithAttachContinuations(true))
+	var entry LogEntry
+	ok, err := parser.ParseInto(&entry)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	clone := entry.Clone()
+	assert.Equal(t, &entry, clone)
+
+	// The slices of the entry are reused by ParseInto.
+	ok, err = parser.ParseInto(&entry)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "first", clone.Message)
+	assert.Equal(t, []LogField{{Name: "a", Value: "1"}, {Name: "b", Value: "2"}}, clone.Fields)
+	assert.Equal(t, []string{"  backtrace"}, clone.Continuation)
+
+	// Mutating the clone leaves the original untouched.
+	clone = entry.Clone()
+	clone.Fields[0].Value = "changed"
+	clone.Header.Line = 1
+	assert.Equal(t, "3", entry.Fields[0].Value)
+	assert.Equal(t, 82, entry.Header.Line)
+
+	assert.Nil(t, (*LogEntry)(nil).Clone())
+}
+
+func TestCollectFieldNames(t *testing.T) {
+	entries, err := ParseFromString(`[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] [msg] [region_id=4] [peer=1] [peer=2]
+[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] [msg]
+[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] [msg] ["Z z"=1] [region_id=5] [addr=x]`)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"Z z", "addr", "peer", "region_id"}, CollectFieldNames(entries))
+	assert.Equal(t, []string{"peer", "region_id"}, CollectFieldNames(append(entries[:1:1], nil)))
+	assert.Equal(t, []string{}, CollectFieldNames(nil))
+}
+
+func TestLogEntry_Field(t *testing.T) {
+	entries, err := ParseFromString(`[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] [msg] [region_id=4] [store_id=1] [peer_id=x] [region_id=5]
+[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] [msg] [id=9]`)
+	assert.NoError(t, err)
+	v, ok := entries[0].Field("region_id")
+	assert.True(t, ok)
+	assert.Equal(t, "4", v)
+	_, ok = entries[1].Field("region_id")
+	assert.False(t, ok)
+
+	id, ok := entries[0].RegionID()
+	assert.True(t, ok)
+	assert.Equal(t, int64(4), id)
+	id, ok = entries[0].StoreID()
+	assert.True(t, ok)
+	assert.Equal(t, int64(1), id)
+	_, ok = entries[0].PeerID()
+	assert.False(t, ok)
+	for _, get := range []func() (int64, bool){entries[1].RegionID, entries[1].StoreID, entries[1].PeerID} {
+		_, ok = get()
+		assert.False(t, ok)
+	}
+}
+
+func TestLogEntry_String(t *testing.T) {
+	log := `[2021/08/04 12:00:43.128 +08:00] [DEBUG] [<unknown>] [""] [k={}] [e=""]
+[2021/08/04 12:00:43.128 Z] [FATAL] [lib.rs:81] ["a]\n\"b"]
+[2021/08/04 12:00:43.128 Z] [INFO] [lib.rs:81] [C:\temp\] [dir=a\]`
+	entries, err := ParseFromString(log)
+	assert.NoError(t, err)
+	assert.Equal(t, `[2021/08/04 12:00:43.128 +08:00] [DEBUG] [<unknown>] [""] [k="{}"] [e=""]`, entries[0].String())
+	assert.Equal(t, `[2021/08/04 12:00:43.128 Z] [FATAL] [lib.rs:81] ["a]\n\"b"]`, entries[1].String())
+	assert.Equal(t, `[2021/08/04 12:00:43.128 Z] [INFO] [lib.rs:81] ["C:\\temp\\"] [dir="a\\"]`, entries[2].String())
+	reparsed, err := ParseFromString(entries[0].String() + "\n" + entries[1].String() + "\n" + entries[2].String())
+	assert.NoError(t, err)
+	for i := range entries {
+		assert.True(t, entries[i].Equal(reparsed[i]))
+	}
+}
+
+func TestLogField_String(t *testing.T) {
+	for _, c := range []struct {
+		field  LogField
+		expect string
+	}{
+		{LogField{Name: "region_id", Value: "4"}, "region_id=4"},
+		{LogField{Name: "endpoints", Value: "127.0.0.1:2379"}, "endpoints=127.0.0.1:2379"},
+		{LogField{Name: "test k2", Value: "test v2"}, `"test k2"="test v2"`},
+		{LogField{Name: "err", Value: `RpcStatus { details: [] }`}, `err="RpcStatus { details: [] }"`},
+		{LogField{Name: "a=b", Value: `say "hi"`}, `"a=b"="say \"hi\""`},
+		{LogField{Name: "html", Value: "<a>&\t"}, `html="<a>&\t"`},
+		{LogField{Name: "empty", Value: ""}, `empty=""`},
+		{LogField{Name: `a\`, Value: "b"}, `"a\\"=b`},
+		{LogField{Name: "path", Value: `C:\Windows\`}, `path="C:\\Windows\\"`},
+		{LogField{Name: `a\=b`, Value: `c\=d`}, `"a\\=b"="c\\=d"`},
+		{LogField{Name: "k", Value: `a\:b`}, `k="a\\:b"`},
+	} {
+		assert.Equal(t, c.expect, c.field.String())
+		assert.Equal(t, c.expect, fmt.Sprint(c.field))
+		// Round trip.
+		entries, err := ParseFromString("[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] [msg] [" + c.field.String() + "]")
+		assert.NoError(t, err, c.expect)
+		assert.Equal(t, c.field.Name, entries[0].Fields[0].Name, c.expect)
+		assert.Equal(t, c.field.Value, entries[0].Fields[0].Value, c.expect)
+	}
+}
+
+func TestMergeByKey(t *testing.T) {
+	entries, err := ParseFromString(`[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] [send] [region_id=1] [to=a] [to=x]
+[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] [send] [region_id=2] [to=a] [size=3]
+[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] [send] [to=a] [region_id="<b>"]
+[2021/08/04 12:00:43.128 +08:00] [WARN] [lib.rs:81] [send] [region_id=4]
+[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] [send] [region_id=5]
+[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] [send] [region_id=5]`)
+	assert.NoError(t, err)
+	key := func(e *LogEntry) string {
+		return fmt.Sprint(e.Header.DateTime.UnixNano(), e.Header.Level, e.Message)
+	}
+	merged := MergeByKey(entries, key)
+	assert.Len(t, merged, 3)
+	assert.Equal(t, []LogField{
+		{Name: "region_id", Value: `["1","2","<b>"]`},
+		{Name: "to", Value: "a"},
+		{Name: "size", Value: "3"},
+	}, merged[0].Fields)
+	assert.Equal(t, "send", merged[0].Message)
+	assert.Same(t, entries[3], merged[1])
+	assert.Equal(t, []LogField{{Name: "region_id", Value: "5"}}, merged[2].Fields)
+	// The input is not modified.
+	assert.Len(t, entries[0].Fields, 3)
+	assert.Equal(t, "1", entries[0].Fields[0].Value)
+
+	// The merged values are parsed back as a JSON array.
+	reparsed, err := ParseFromString(merged[0].String())
+	assert.NoError(t, err)
+	assert.True(t, merged[0].Equal(reparsed[0]))
+
+	assert.Empty(t, MergeByKey(nil, key))
+}
@@ -0,0 +1,71 @@
+package logparser
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Stages of parsing a log entry, reported by ParseError.Stage.
+const (
+	StageDatetime = "datetime"
+	StageLevel    = "level"
+	StageFileLine = "fileline"
+	StageMessage  = "message"
+	StageField    = "field"
+	// StageContinuation is the stage of reading continuation lines, see
+	// WithAttachContinuations.
+	StageContinuation = "continuation"
+)
+
+// ErrIncompleteEntry is matched by errors.Is, when the stream ends in the
+// middle of a log entry, e.g. the last line of a log file was cut off by a
+// crash. The error also wraps the underlying io.EOF or io.ErrUnexpectedEOF.
+// The end of the stream between entries is not an error.
+var ErrIncompleteEntry = errors.New("incomplete log entry")
+
+// ErrNotEntryStart is matched by errors.Is, when ParseEntryAt is given an
+// offset which is not at the start of a log entry.
+var ErrNotEntryStart = errors.New("not at the start of a log entry")
+
+// incompleteEntryError wraps an EOF error hit in the middle of an entry.
+type incompleteEntryError struct {
+	err error
+}
+
+func (e *incompleteEntryError) Error() string {
+	return "incomplete log entry: " + e.err.Error()
+}
+
+func (e *incompleteEntryError) Is(target error) bool {
+	return target == ErrIncompleteEntry
+}
+
+func (e *incompleteEntryError) Unwrap() error {
+	return e.err
+}
+
+// ParseError is returned by StreamParser when a log entry does not match
+// the expected format. Use errors.As to inspect it.
+type ParseError struct {
+	// Line is the line number where the error occurred, starting from 1.
+	Line int
+	// Column is the position of the last rune read in the line, counted in
+	// runes starting from 1, or 0 if nothing was read from the line yet.
+	Column int
+	// Stage is the part of the log entry being parsed, one of the Stage*
+	// constants.
+	Stage string
+	// Snippet holds the text of the line read up to the failure point.
+	// At most the last 256 bytes are kept.
+	Snippet string
+	// Err is the underlying cause.
+	Err error
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("invalid log format at line %d, column %d, cause: %v", e.Line, e.Column, e.Err)
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,99 @@
+package logparser
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseError(t *testing.T) {
+	for _, c := range []struct {
+		log   string
+		line  int
+		stage string
+	}{
+		{"[2021/08/04 12:00:43.128 +08:00]x", 1, StageLevel},
+		{"[2021/08/04] [INFO] [lib.rs:81] [msg]", 1, StageDatetime},
+		{"\n[2021/08/04 12:00:43.128 +08:00] [NOTICE] [lib.rs:81] [msg]", 2, StageLevel},
+		{"[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:x] [msg]", 1, StageFileLine},
+		{"[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] [\"msg]", 1, StageMessage},
+		{"[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] [msg] [k]", 1, StageField},
+	} {
+		_, err := ParseFromString(c.log)
+		var perr *ParseError
+		assert.True(t, errors.As(err, &perr), c.log)
+		assert.Equal(t, c.line, perr.Line, c.log)
+		assert.Equal(t, c.stage, perr.Stage, c.log)
+		assert.NotNil(t, errors.Unwrap(err), c.log)
+	}
+}
+
+func TestParseError_Snippet(t *testing.T) {
+	_, err := ParseFromString("[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] [msg]\n[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:8x] [msg]")
+	var perr *ParseError
+	assert.True(t, errors.As(err, &perr))
+	assert.Equal(t, 2, perr.Line)
+	assert.Equal(t, "[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:8x]", perr.Snippet)
+
+	// The snippet is bounded in length.
+	_, err = ParseFromString("[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] [msg] [k=" + strings.Repeat("值", 1000) + " ]")
+	assert.True(t, errors.As(err, &perr))
+	assert.LessOrEqual(t, len(perr.Snippet), 256)
+	assert.True(t, utf8.ValidString(perr.Snippet))
+	assert.True(t, strings.HasSuffix(perr.Snippet, "值 "))
+}
+
+func TestParseError_Column(t *testing.T) {
+	for _, c := range []struct {
+		log    string
+		line   int
+		column int
+	}{
+		{"[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] [msg]\n[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:8x]", 2, 51},
+		{"\r\n\n  x", 3, 3},
+		{"[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] [消息]x", 1, 57},
+		{"[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] [msg] [k=v] [k==v]", 1, 68},
+	} {
+		_, err := ParseFromString(c.log)
+		var perr *ParseError
+		assert.True(t, errors.As(err, &perr), c.log)
+		assert.Equal(t, c.line, perr.Line, c.log)
+		assert.Equal(t, c.column, perr.Column, c.log)
+		assert.Contains(t, err.Error(), fmt.Sprintf("at line %d, column %d,", c.line, c.column), c.log)
+	}
+}
+
+func TestErrIncompleteEntry(t *testing.T) {
+	entry := `[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] ["Welcome"] [k=v]`
+	complete := strings.Index(entry, " [k=v]")
+	for i := 1; i < len(entry); i++ {
+		if i == complete || i == complete+1 {
+			// The fields are optional.
+			continue
+		}
+		for _, opt := range []Option{WithLineBuffer(false), WithLineBuffer(true)} {
+			_, err := ParseFromString(entry+"\n"+entry[:i], opt)
+			assert.True(t, errors.Is(err, ErrIncompleteEntry), entry[:i])
+			var perr *ParseError
+			assert.True(t, errors.As(err, &perr), entry[:i])
+		}
+	}
+	_, err := ParseFromString(`[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] ["Welcome`)
+	assert.True(t, errors.Is(err, ErrIncompleteEntry))
+	assert.Contains(t, err.Error(), "incomplete log entry: unterminated quoted string")
+
+	// Clean EOF.
+	for _, log := range []string{entry, entry + "\n", entry + "\n\n"} {
+		entries, err := ParseFromString(log)
+		assert.NoError(t, err)
+		assert.Len(t, entries, 1)
+	}
+	// Not an EOF.
+	_, err = ParseFromString(entry + "\n[2021/08/04 12:00:43.128 +08:00] [BAD] [lib.rs:81] [msg]")
+	assert.Error(t, err)
+	assert.False(t, errors.Is(err, ErrIncompleteEntry))
+}
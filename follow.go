@@ -0,0 +1,84 @@
+package logparser
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// DefaultFollowInterval is the poll interval used by NewFollowParser when
+// the given interval is not positive.
+const DefaultFollowInterval = 200 * time.Millisecond
+
+// FollowParser parses a log stream which is still being written, like
+// `tail -f`. When the underlying reader reaches io.EOF, instead of
+// terminating, FollowParser waits for more data by polling the reader
+// periodically. A write landing in the middle of an entry is handled
+// naturally, as parsing simply resumes when the rest of the entry arrives.
+//
+// Note that an entry is only returned once the line break after it (or the
+// beginning of the next entry) has been read, since more fields may follow.
+type FollowParser struct {
+	parser *StreamParser
+	reader *followReader
+}
+
+// NewFollowParser creates a new *FollowParser which polls r every interval
+// once it reaches io.EOF.
+func NewFollowParser(r io.Reader, interval time.Duration, opts ...Option) *FollowParser {
+	if interval <= 0 {
+		interval = DefaultFollowInterval
+	}
+	fr := &followReader{
+		r:        r,
+		interval: interval,
+		stop:     make(chan struct{}),
+	}
+	return &FollowParser{
+		parser: NewStreamParser(fr, opts...),
+		reader: fr,
+	}
+}
+
+// ParseNext blocks until the next LogEntry is available and returns it.
+// After Stop is called, the remaining data is parsed as usual and
+// (nil, nil) is returned at the end of the stream.
+func (f *FollowParser) ParseNext() (*LogEntry, error) {
+	return f.parser.ParseNext()
+}
+
+// Stop breaks the follow loop: the next time the underlying reader reaches
+// io.EOF, it is treated as the end of the stream. Stop may be called from
+// any goroutine, and more than once.
+func (f *FollowParser) Stop() {
+	f.reader.once.Do(func() {
+		close(f.reader.stop)
+	})
+}
+
+// followReader is an io.Reader which retries on io.EOF until stopped.
+type followReader struct {
+	r        io.Reader
+	interval time.Duration
+	stop     chan struct{}
+	once     sync.Once
+}
+
+func (fr *followReader) Read(b []byte) (int, error) {
+	for {
+		n, err := fr.r.Read(b)
+		if n > 0 {
+			return n, nil
+		}
+		if err != nil && err != io.EOF {
+			return 0, err
+		}
+		timer := time.NewTimer(fr.interval)
+		select {
+		case <-fr.stop:
+			timer.Stop()
+			return 0, io.EOF
+		case <-timer.C:
+		}
+	}
+}
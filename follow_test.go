@@ -0,0 +1,101 @@
+package logparser
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// growingBuffer behaves like a file which is being appended to: reads
+// return io.EOF once all written data is consumed.
+type growingBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *growingBuffer) Read(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Read(p)
+}
+
+func (b *growingBuffer) WriteString(s string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.buf.WriteString(s)
+}
+
+func TestFollowParser(t *testing.T) {
+	buf := &growingBuffer{}
+	parser := NewFollowParser(buf, time.Millisecond)
+	go func() {
+		for _, chunk := range []string{
+			"[2021/08/04 12:00:43.128 +08:00] [IN",
+			"FO] [lib.rs:81] [\"Welcome ",
+			"to TiKV\"]",
+			" [k1=v1]",
+			" [k2=v2]\n",
+			"[2021/08/04 12:00:43.129 +08:00] [INFO] [lib.rs:86] [second]\n",
+		} {
+			time.Sleep(5 * time.Millisecond)
+			buf.WriteString(chunk)
+		}
+	}()
+	entry, err := parser.ParseNext()
+	assert.NoError(t, err)
+	assert.Equal(t, "Welcome to TiKV", entry.Message)
+	assert.Equal(t, []LogField{{Name: "k1", Value: "v1"}, {Name: "k2", Value: "v2"}}, entry.Fields)
+	entry, err = parser.ParseNext()
+	assert.NoError(t, err)
+	assert.Equal(t, "second", entry.Message)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		entry, err := parser.ParseNext()
+		assert.NoError(t, err)
+		assert.Nil(t, entry)
+	}()
+	select {
+	case <-done:
+		t.Fatal("ParseNext returned before Stop")
+	case <-time.After(20 * time.Millisecond):
+	}
+	parser.Stop()
+	parser.Stop()
+	<-done
+}
+
+func TestFollowParser_lookAhead(t *testing.T) {
+	// The options looking ahead must not wait for more input than the
+	// written entry.
+	for _, opts := range [][]Option{
+		{WithOptionalFileLine(true)},
+		{WithFlexibleTokenOrder(true)},
+		{WithLastFieldGreedy(true)},
+	} {
+		r, w := io.Pipe()
+		go func() {
+			_, _ = io.WriteString(w, "[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] [msg] [k=v]\n")
+		}()
+		parser := NewFollowParser(r, 10*time.Millisecond, opts...)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			entry, err := parser.ParseNext()
+			assert.NoError(t, err)
+			assert.Equal(t, "msg", entry.Message)
+		}()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatal("ParseNext blocked on the look-ahead")
+		}
+		parser.Stop()
+		w.Close()
+	}
+}
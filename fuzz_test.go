@@ -0,0 +1,99 @@
+//go:build go1.18
+// +build go1.18
+
+package logparser
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"regexp"
+	"testing"
+)
+
+// fuzzSeeds are logs covering the syntax the parser accepts, in addition to
+// the lines of the benchmark log.
+var fuzzSeeds = []string{
+	`[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] ["Welcome to TiKV"]`,
+	`[2021/08/04 12:00:43.129 +08:00] [DEBUG] [<unknown>] [test_message] [test_k1=test_v1] ["test k2"="test \"v2\""]`,
+	`  [2021/08/04 12:00:43.129 +08:00] [WARN] [lib.rs:86] ["Release Version:   5.1.0-alpha"] ["值"=值]`,
+	"[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] [msg] [stats={\"hit\":1,\"miss\":[1,[2]]}] [k=vec\\[0\\]]\r\n  backtrace\n\n",
+	"[2021/08/04 12:00:43.128 Z] [FATAL] [lib.rs:81] [\"a]\\n\\\"b\"] [k=v] // comment\n",
+	"\xef\xbb\xbf[2021/08/04 12:00:43.128 -05:00] [E] [main.go:1] [k:v] [msg] tail",
+	"host1 2021/08/04 12:00:43,128 +08:00 [INFO] [lib.rs:99999999999999999999] [x]",
+}
+
+// fuzzOptions returns a combination of options selected by the bits of b.
+func fuzzOptions(b uint32) []Option {
+	var opts []Option
+	for i, opt := range []Option{
+		WithLineBuffer(true),
+		WithAttachContinuations(true),
+		WithFlexibleTokenOrder(true),
+		WithFlexibleWhitespace(true),
+		WithBracketBalancedBareValues(true),
+		WithFieldSeparator(':'),
+		WithTrailingComment("//"),
+		WithPartialEntries(true),
+		WithUnbracketedMessage(true),
+		WithOptionalFileLine(true),
+		WithUnbracketedDatetime(true),
+		WithLinePrefix(regexp.MustCompile(`^\S+ `)),
+		WithControlCharPolicy(ControlCharReplace),
+		WithTrailingTokenPolicy(TrailingTokenCapture),
+		WithBufferSize(16),
+		WithMessageDelimiters('{', '}'),
+		WithBracketEscaping(true),
+		WithDoubledQuoteEscaping(true),
+		WithLastFieldGreedy(true),
+		WithStringInterning(true),
+		WithCommaFractionalSeconds(true),
+		WithStrictDatetime(true),
+	} {
+		if b&(1<<i) != 0 {
+			opts = append(opts, opt)
+		}
+	}
+	return opts
+}
+
+func FuzzParseNext(f *testing.F) {
+	for _, seed := range fuzzSeeds {
+		f.Add([]byte(seed), uint32(0))
+		f.Add([]byte(seed), uint32(0xffffffff))
+	}
+	if file, err := os.Open("benches/bench_100k.log"); err == nil {
+		s := bufio.NewScanner(file)
+		for i := 0; i < 50 && s.Scan(); i++ {
+			f.Add(append([]byte(nil), s.Bytes()...), uint32(i))
+		}
+		file.Close()
+	}
+	f.Fuzz(func(t *testing.T, log []byte, options uint32) {
+		// Only errors are expected, never a panic.
+		entries, err := ParseFromBytes(log, fuzzOptions(options)...)
+		if err == nil {
+			for _, e := range entries {
+				_ = e.String()
+			}
+		}
+	})
+}
+
+func FuzzNextToken(f *testing.F) {
+	for _, seed := range fuzzSeeds {
+		f.Add([]byte(seed), uint32(0))
+		f.Add([]byte(seed), uint32(0xffffffff))
+	}
+	f.Fuzz(func(t *testing.T, log []byte, options uint32) {
+		// The tokenizer starts over after an error, so keep going, but give
+		// up eventually in case an error does not consume any input.
+		p := NewStreamParser(bytes.NewReader(log), fuzzOptions(options)...)
+		for i := 0; i < 2*len(log)+16; i++ {
+			tok, err := p.NextToken()
+			if err == nil && tok.Kind == TokenEOF {
+				return
+			}
+		}
+	})
+}
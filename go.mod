@@ -2,4 +2,7 @@ module github.com/mornyx/landing-log-parser
 
 go 1.16
 
-require github.com/stretchr/testify v1.7.0 // indirect
+require (
+	github.com/stretchr/testify v1.7.0
+	google.golang.org/protobuf v1.28.1
+)
@@ -0,0 +1,26 @@
+//go:build go1.23
+
+package logparser
+
+import "iter"
+
+// All returns an iterator over the remaining log entries, to be used as
+// `for entry, err := range parser.All()`. Each entry is yielded with a nil
+// error. On a parse error, (nil, err) is yielded and the iteration stops.
+func (p *StreamParser) All() iter.Seq2[*LogEntry, error] {
+	return func(yield func(*LogEntry, error) bool) {
+		for {
+			entry, err := p.ParseNext()
+			if err != nil {
+				yield(nil, err)
+				return
+			}
+			if entry == nil {
+				return
+			}
+			if !yield(entry, nil) {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,47 @@
+//go:build go1.23
+
+package logparser
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStreamParser_All(t *testing.T) {
+	parser := NewStreamParser(strings.NewReader(`[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] ["Welcome to TiKV"]
+[2021/08/04 12:00:43.129 +08:00] [INFO] [lib.rs:86] ["Release Version:   5.1.0-alpha"]`))
+	var messages []string
+	for entry, err := range parser.All() {
+		assert.NoError(t, err)
+		messages = append(messages, entry.Message)
+	}
+	assert.Equal(t, []string{"Welcome to TiKV", "Release Version:   5.1.0-alpha"}, messages)
+
+	parser = NewStreamParser(strings.NewReader(`[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] ["Welcome to TiKV"]
+[2021/08/04 12:00:43.129 +08:00] [INFO] [lib.rs:x] ["Release Version:   5.1.0-alpha"]
+[2021/08/04 12:00:43.129 +08:00] [INFO] [lib.rs:86] ["unreachable"]`))
+	n := 0
+	var lastErr error
+	for entry, err := range parser.All() {
+		n++
+		if err != nil {
+			assert.Nil(t, entry)
+			lastErr = err
+		}
+	}
+	assert.Equal(t, 2, n)
+	assert.Error(t, lastErr)
+
+	// Breaking early is fine.
+	parser = NewStreamParser(strings.NewReader(`[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] [first]
+[2021/08/04 12:00:43.129 +08:00] [INFO] [lib.rs:86] [second]`))
+	for entry := range parser.All() {
+		assert.Equal(t, "first", entry.Message)
+		break
+	}
+	entry, err := parser.ParseNext()
+	assert.NoError(t, err)
+	assert.Equal(t, "second", entry.Message)
+}
@@ -0,0 +1,39 @@
+package logparser
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+)
+
+// jsonlFlushInterval is the number of entries WriteJSONL writes between
+// flushes.
+const jsonlFlushInterval = 64
+
+// WriteJSONL parses the whole stream and writes each entry to w as a single
+// line JSON object followed by '\n'. It stops on the first parse error and
+// returns it, after all prior entries have been written.
+func (p *StreamParser) WriteJSONL(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	for n := 1; ; n++ {
+		entry, err := p.ParseNext()
+		if err != nil {
+			if ferr := bw.Flush(); ferr != nil {
+				return ferr
+			}
+			return err
+		}
+		if entry == nil {
+			return bw.Flush()
+		}
+		if err := enc.Encode(entry); err != nil {
+			return err
+		}
+		if n%jsonlFlushInterval == 0 {
+			if err := bw.Flush(); err != nil {
+				return err
+			}
+		}
+	}
+}
@@ -0,0 +1,35 @@
+package logparser
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStreamParser_WriteJSONL(t *testing.T) {
+	log := `[2021/09/23 14:25:14.123 +08:00] [INFO] [a.go:1] [first] [k=v]
+[2021/09/23 14:25:14.123 +08:00] [WARN] [a.go:2] ["second"]
+`
+	var buf bytes.Buffer
+	parser := NewStreamParser(strings.NewReader(log))
+	assert.NoError(t, parser.WriteJSONL(&buf))
+	lines := strings.Split(buf.String(), "\n")
+	assert.Len(t, lines, 3)
+	assert.Equal(t, "", lines[2])
+	entries, err := ParseFromString(log)
+	assert.NoError(t, err)
+	for i, entry := range entries {
+		expect, err := json.Marshal(entry)
+		assert.NoError(t, err)
+		assert.Equal(t, string(expect), lines[i])
+	}
+
+	// Prior entries are written before the error.
+	buf.Reset()
+	parser = NewStreamParser(strings.NewReader(log + "bad\n"))
+	assert.Error(t, parser.WriteJSONL(&buf))
+	assert.Equal(t, 2, strings.Count(buf.String(), "\n"))
+}
@@ -7,13 +7,18 @@ package logparser
 import (
 	"bufio"
 	"bytes"
+	"compress/gzip"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"os"
+	"regexp"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 )
 
 // LogLevel is an enumeration type for the log level.
@@ -44,37 +49,133 @@ func (l LogLevel) String() string {
 	}
 }
 
+// MarshalJSON encodes the log level as its string name, like "INFO".
+func (l LogLevel) MarshalJSON() ([]byte, error) {
+	return json.Marshal(l.String())
+}
+
+// UnmarshalJSON decodes the log level from its string name. Integers are
+// accepted as well, for data encoded before levels were named.
+func (l *LogLevel) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		var n int
+		if json.Unmarshal(b, &n) != nil {
+			return err
+		}
+		*l = LogLevel(n)
+		return nil
+	}
+	level, err := StringToLogLevel(s)
+	if err != nil {
+		return err
+	}
+	*l = level
+	return nil
+}
+
 // StringToLogLevel converts the string log level to the enumeration type.
-// An error is returned if the string is not recognized.
+// An error is returned if the string is not recognized. The single-letter
+// abbreviations are accepted as well, with the mapping:
+//
+//	D -> DEBUG
+//	I -> INFO
+//	W -> WARN
+//	E -> ERROR
+//	F -> FATAL
+//
+// The initials of the five levels are distinct, so D always means DEBUG.
 func StringToLogLevel(s string) (LogLevel, error) {
 	switch strings.ToUpper(s) {
-	case "DEBUG":
+	case "DEBUG", "D":
 		return LogLevelDebug, nil
-	case "INFO":
+	case "INFO", "I":
 		return LogLevelInfo, nil
-	case "WARN":
+	case "WARN", "W":
 		return LogLevelWarn, nil
-	case "ERROR":
+	case "ERROR", "E":
 		return LogLevelError, nil
-	case "FATAL":
+	case "FATAL", "F":
 		return LogLevelFatal, nil
 	default:
 		return LogLevelInfo, fmt.Errorf("unexpected log level string '%s'", s)
 	}
 }
 
+// Syslog returns the RFC 5424 severity of the log level. The mapping is:
+//
+//	FATAL -> 2 (Critical)
+//	ERROR -> 3 (Error)
+//	WARN  -> 4 (Warning)
+//	INFO  -> 6 (Informational)
+//	DEBUG -> 7 (Debug)
+//
+// FATAL is mapped to Critical rather than Alert or Emergency, since a fatal
+// log means the process itself can not continue, not the whole system.
+// -1 is returned for unknown log levels.
+func (l LogLevel) Syslog() int {
+	switch l {
+	case LogLevelDebug:
+		return 7
+	case LogLevelInfo:
+		return 6
+	case LogLevelWarn:
+		return 4
+	case LogLevelError:
+		return 3
+	case LogLevelFatal:
+		return 2
+	default:
+		return -1
+	}
+}
+
+// LogLevelFromSyslog converts a RFC 5424 severity to the log level. It is
+// the reverse of LogLevel.Syslog, with the severities lacking a counterpart
+// mapped to the closest level: Emergency (0) and Alert (1) to FATAL, and
+// Notice (5) to INFO. An error is returned if the severity is out of 0-7.
+func LogLevelFromSyslog(severity int) (LogLevel, error) {
+	switch severity {
+	case 0, 1, 2:
+		return LogLevelFatal, nil
+	case 3:
+		return LogLevelError, nil
+	case 4:
+		return LogLevelWarn, nil
+	case 5, 6:
+		return LogLevelInfo, nil
+	case 7:
+		return LogLevelDebug, nil
+	default:
+		return LogLevelInfo, fmt.Errorf("unexpected syslog severity %d", severity)
+	}
+}
+
+// datetimeLayout is the layout of the datetime in a log header. The zone
+// can be either an offset like "+08:00" or "Z" for UTC.
+const datetimeLayout = "2006/01/02 15:04:05.000 Z07:00"
+
 // LogHeader defines the header of one log.
+// When encoded as JSON, DateTime is formatted as RFC 3339 with nanoseconds
+// and Level as its string name.
 type LogHeader struct {
 	DateTime time.Time
 	Level    LogLevel
 	File     string
 	Line     int
+	// OriginalOffset is the zone offset of the datetime in the log, in
+	// seconds east of UTC, if DateTime is normalized to UTC, see
+	// WithNormalizeUTC.
+	OriginalOffset int `json:",omitempty"`
 }
 
 // LogField defines one k/v field of one log.
 type LogField struct {
 	Name  string
 	Value string
+	// ValueQuoted reports whether the value was a quoted string in the log,
+	// like `[k="v"]`, rather than a bare literal like `[k=v]`.
+	ValueQuoted bool `json:",omitempty"`
 }
 
 // LogEntry defines an entire log entry.
@@ -82,23 +183,154 @@ type LogEntry struct {
 	Header  LogHeader
 	Message string
 	Fields  []LogField // TODO: considering hashmap
+	// MessageQuoted reports whether the message was a quoted string in the
+	// log, like `["connecting to PD"]`, rather than a bare literal like
+	// `[connecting]`.
+	MessageQuoted bool `json:",omitempty"`
+	// Continuation holds the following lines which do not start a new
+	// entry, e.g. a backtrace, see WithAttachContinuations.
+	Continuation []string `json:",omitempty"`
+	// Comment is the trailing comment after the fields, without the
+	// prefix, see WithTrailingComment.
+	Comment string `json:",omitempty"`
+	// Source is the prefix of the line before the datetime, e.g. a host
+	// name added by syslog, see WithLinePrefix.
+	Source string `json:",omitempty"`
+	// Partial reports whether the stream ended in the middle of the entry,
+	// so only the tokens before the truncation are set, see
+	// WithPartialEntries.
+	Partial bool `json:",omitempty"`
+	// Trailer is the unexpected text after the fields, see
+	// TrailingTokenCapture.
+	Trailer string `json:",omitempty"`
 }
 
 // ParseFromBytes parses a byte slice as *LogEntry slice.
-func ParseFromBytes(r []byte) ([]*LogEntry, error) {
-	return ParseFromReader(bytes.NewReader(r))
+func ParseFromBytes(r []byte, opts ...Option) ([]*LogEntry, error) {
+	return ParseFromReader(bytes.NewReader(r), opts...)
 }
 
 // ParseFromString parses a string as *LogEntry slice.
-func ParseFromString(r string) ([]*LogEntry, error) {
-	return ParseFromReader(strings.NewReader(r))
+func ParseFromString(r string, opts ...Option) ([]*LogEntry, error) {
+	return ParseFromReader(strings.NewReader(r), opts...)
 }
 
 // ParseFromReader parses a byte stream from io.Reader as *LogEntry slice.
 // The function continues to run until the reader returns io.EOF.
-func ParseFromReader(r io.Reader) ([]*LogEntry, error) {
+func ParseFromReader(r io.Reader, opts ...Option) ([]*LogEntry, error) {
+	return ParseFromReaderSized(r, 0, opts...)
+}
+
+// ParseFromReaderSized is like ParseFromReader, but pre-allocates the result
+// for hint entries, which saves reallocations if the number of entries is
+// roughly known, e.g. from the size of the file.
+func ParseFromReaderSized(r io.Reader, hint int, opts ...Option) ([]*LogEntry, error) {
+	var entries []*LogEntry
+	if hint > 0 {
+		entries = make([]*LogEntry, 0, hint)
+	}
+	p := NewStreamParser(r, opts...)
+	for {
+		entry, err := p.ParseNext()
+		if err != nil {
+			return nil, err
+		}
+		if entry == nil {
+			break
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// ParseFromStringN parses at most the first n entries of a string, see
+// ParseFromReaderN.
+func ParseFromStringN(r string, n int, opts ...Option) ([]*LogEntry, error) {
+	return ParseFromReaderN(strings.NewReader(r), n, opts...)
+}
+
+// ParseFromReaderN parses at most the first n entries from io.Reader, e.g. to
+// preview a large log. The rest of the stream is not parsed, though some of
+// it may have been read into the buffer. Fewer entries are returned if the
+// reader returns io.EOF before.
+func ParseFromReaderN(r io.Reader, n int, opts ...Option) ([]*LogEntry, error) {
+	var entries []*LogEntry
+	if n <= 0 {
+		return entries, nil
+	}
+	p := NewStreamParser(r, opts...)
+	for len(entries) < n {
+		entry, err := p.ParseNext()
+		if err != nil {
+			return nil, err
+		}
+		if entry == nil {
+			break
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// ParseTail parses the whole byte stream like ParseFromReader, but only
+// keeps the last n entries, which are returned in order. The memory usage is
+// bounded by n regardless of the size of the stream.
+func ParseTail(r io.Reader, n int, opts ...Option) ([]*LogEntry, error) {
+	if n <= 0 {
+		return nil, Validate(r, opts...)
+	}
+	ring := make([]*LogEntry, 0, n)
+	next := 0 // The oldest entry once the ring is full.
+	p := NewStreamParser(r, opts...)
+	for {
+		entry, err := p.ParseNext()
+		if err != nil {
+			return nil, err
+		}
+		if entry == nil {
+			break
+		}
+		if len(ring) < n {
+			ring = append(ring, entry)
+			continue
+		}
+		ring[next] = entry
+		next = (next + 1) % n
+	}
+	return append(ring[next:], ring[:next]...), nil
+}
+
+// ParseDedup parses the byte stream like ParseFromReader, but drops an entry
+// if it is equal to the entry right before it, as reported by
+// LogEntry.Equal, e.g. an entry written twice by a retry. Only consecutive
+// duplicates are dropped.
+func ParseDedup(r io.Reader, opts ...Option) ([]*LogEntry, error) {
+	var entries []*LogEntry
+	var last *LogEntry
+	p := NewStreamParser(r, opts...)
+	for {
+		entry, err := p.ParseNext()
+		if err != nil {
+			return nil, err
+		}
+		if entry == nil {
+			break
+		}
+		if last != nil && entry.Equal(last) {
+			continue
+		}
+		entries = append(entries, entry)
+		last = entry
+	}
+	return entries, nil
+}
+
+// ParseTimeWindow parses the byte stream like ParseFromReader, but only
+// keeps the entries whose DateTime is in [from, to). With WithAssumeSorted,
+// it stops at the first entry at or after to, without parsing the rest.
+func ParseTimeWindow(r io.Reader, from, to time.Time, opts ...Option) ([]*LogEntry, error) {
 	var entries []*LogEntry
-	p := NewStreamParser(r)
+	p := NewStreamParser(r, opts...)
 	for {
 		entry, err := p.ParseNext()
 		if err != nil {
@@ -107,372 +339,1943 @@ func ParseFromReader(r io.Reader) ([]*LogEntry, error) {
 		if entry == nil {
 			break
 		}
+		t := entry.Header.DateTime
+		if !t.Before(to) {
+			if p.assumeSorted {
+				break
+			}
+			continue
+		}
+		if !t.Before(from) {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+// ParseFromReaders parses the byte streams from readers in sequence as a
+// single *LogEntry slice, e.g. rotated log files in chronological order,
+// with the same options for all of them. Each reader is expected to contain
+// whole entries, since an entry never spans two readers. Line numbers
+// restart from 1 for each reader, and an error is annotated with the index
+// of the reader it came from.
+func ParseFromReaders(readers []io.Reader, opts ...Option) ([]*LogEntry, error) {
+	var entries []*LogEntry
+	var p *StreamParser
+	for i, r := range readers {
+		if p == nil {
+			p = NewStreamParser(r, opts...)
+		} else {
+			p.Reset(r)
+		}
+		for {
+			entry, err := p.ParseNext()
+			if err != nil {
+				return nil, fmt.Errorf("reader %d: %w", i, err)
+			}
+			if entry == nil {
+				break
+			}
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+// Validate parses the whole stream and reports the first parse error, or
+// nil if the log is well-formed. No LogEntry is built, which makes it
+// cheaper than ParseFromReader to check the format of a log, especially
+// with WithLineBuffer.
+func Validate(r io.Reader, opts ...Option) error {
+	p := NewStreamParser(r, opts...)
+	var tok Token
+	for {
+		if err := p.scanToken(&tok); err != nil {
+			return err
+		}
+		if tok.Kind == TokenEOF {
+			return nil
+		}
+	}
+}
+
+// ParseFromFile parses the file at path as *LogEntry slice. Gzip compressed
+// files are detected by their magic bytes and decompressed transparently.
+func ParseFromFile(path string, opts ...Option) ([]*LogEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	br := bufio.NewReader(f)
+	var r io.Reader = br
+	if magic, _ := br.Peek(2); bytes.Equal(magic, gzipMagic) {
+		gr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		defer gr.Close()
+		r = gr
+	}
+	return ParseFromReader(r, opts...)
+}
+
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// StreamParser is a parser implementation which parses bytes from
+// io.Reader into individual *LogEntry. Users can parse large log files
+// on demand without having to read them all into memory at once.
+type StreamParser struct {
+	br          *bufio.Reader
+	line        int
+	datetimeBuf []byte
+	fileLineBuf []byte
+	literalBuf  []byte
+	levelBuf    [maxLogLevelLen]byte
+	levelLen    int
+	// lastStage is the last stage of an entry successfully parsed.
+	lastStage string
+
+	// blankLines is the number of blank lines skipped since the last entry,
+	// see WithBlankLineFunc.
+	blankLines int
+	// lineEnding is the first line ending seen, see LineEnding.
+	lineEnding       string
+	mixedLineEndings bool
+
+	// levelCounts is the number of entries parsed by level, indexed from
+	// LogLevelDebug.
+	levelCounts [LogLevelFatal - LogLevelDebug + 1]int
+
+	// Tokenizer state, see NextToken.
+	state      scanState
+	fieldCount int
+	inEntry    bool
+	entryLevel LogLevel
+	bomChecked bool
+	captureRaw bool
+	rawBuf     []byte
+
+	// lineBuf holds the most recent bytes of the current line, which are
+	// reported as ParseError.Snippet.
+	lineBuf      []byte
+	lastRuneSize int
+	// column is the number of runes read from the current line.
+	column int
+	// lineLen is the number of bytes read from the current line, and
+	// lastSize the size of the last rune read, see WithMaxLineLength.
+	lineLen  int
+	lastSize int
+
+	// src reads from the underlying io.Reader. It is the same as br, except
+	// in line buffer mode while an entry is being parsed, when br reads from
+	// the loaded line instead.
+	src        *bufio.Reader
+	counter    countingReader
+	lineBytes  []byte
+	lineStr    string
+	lineSrc    strings.Reader
+	lineBr     *bufio.Reader
+	lineLoaded bool
+	// lineCR is true if the loaded line ends with "\r\n".
+	lineCR bool
+
+	maxFields                 int
+	maxMessageLen             int
+	unbracketedMessage        bool
+	fieldSep                  rune
+	msgOpen                   rune
+	msgClose                  rune
+	lineBuffer                bool
+	strictDatetime            bool
+	location                  *time.Location
+	attachContinuations       bool
+	doubledQuoteEscaping      bool
+	optionalFileLine          bool
+	bracketBalancedBareValues bool
+	bracketEscaping           bool
+	bufferSize                int
+	concurrencyCheck          bool
+	linePrefix                *regexp.Regexp
+	warnFunc                  func(line int, msg string)
+	internNames               bool
+	internTable               map[string]string
+	internBuf                 []byte
+	commentPrefix             string
+	epochUnit                 time.Duration
+	normalizeUTC              bool
+	lastFieldGreedy           bool
+	valueValidator            func(c rune) bool
+	fieldNameTransform        func(name string) string
+	flexibleTokenOrder        bool
+	blankLineFunc             func(count int)
+	controlCharPolicy         ControlCharPolicy
+	commaFractionalSeconds    bool
+	maxLineLength             int
+	defaultLocation           *time.Location
+	levelAliases              map[string]LogLevel
+	unbracketedDatetime       bool
+	datetimeParser            func(token string) (time.Time, error)
+	flexibleWhitespace        bool
+	assumeSorted              bool
+	partialEntries            bool
+	trailingTokenPolicy       TrailingTokenPolicy
+	// literalQuoted reports whether the last literal was a quoted string.
+	literalQuoted bool
+	// busy is 1 while the parser is in use, see WithConcurrencyCheck.
+	busy int32
+}
+
+// NewStreamParser creates new *StreamParser associated with the io.Reader.
+// The behavior of the parser can be customized by passing Option values.
+func NewStreamParser(r io.Reader, opts ...Option) *StreamParser {
+	p := &StreamParser{
+		line:     1,
+		fieldSep: '=',
+		msgOpen:  '[',
+		msgClose: ']',
+	}
+	for _, opt := range opts {
+		opt(p)
+	}
+	p.counter.r = r
+	if p.bufferSize > 0 {
+		p.src = bufio.NewReaderSize(&p.counter, p.bufferSize)
+	} else {
+		p.src = bufio.NewReader(&p.counter)
+	}
+	p.br = p.src
+	return p
+}
+
+// Reset discards any buffered data and parsing state, and switches the
+// parser to read from r. Options given to NewStreamParser are retained.
+func (p *StreamParser) Reset(r io.Reader) {
+	p.unloadLine()
+	p.counter = countingReader{r: r}
+	p.src.Reset(&p.counter)
+	p.line = 1
+	p.lineBuf = p.lineBuf[:0]
+	p.lastRuneSize = 0
+	p.column = 0
+	p.lineLen = 0
+	p.lastSize = 0
+	p.lineCR = false
+	p.captureRaw = false
+	p.rawBuf = p.rawBuf[:0]
+	p.literalQuoted = false
+	p.datetimeBuf = p.datetimeBuf[:0]
+	p.levelLen = 0
+	p.lastStage = ""
+	p.state = stateEntryStart
+	p.fieldCount = 0
+	p.inEntry = false
+	p.bomChecked = false
+	p.levelCounts = [len(p.levelCounts)]int{}
+	p.lineEnding = ""
+	p.mixedLineEndings = false
+	p.blankLines = 0
+}
+
+// ParseNext reads and parses one LogEntry from bufio.Reader on demand.
+// This function will return (nil, nil) if the underlying io.Reader returns
+// io.EOF in the standard case. If the stream ends in the middle of an
+// entry, the returned error matches ErrIncompleteEntry, unless
+// WithPartialEntries is set.
+func (p *StreamParser) ParseNext() (*LogEntry, error) {
+	if p.concurrencyCheck {
+		p.enter()
+		defer p.leave()
+	}
+	var tok Token
+	err := p.scanToken(&tok)
+	if err == nil && tok.Kind == TokenEOF {
+		return nil, nil
+	}
+	entry := &LogEntry{}
+	if err == nil {
+		err = p.parseEntry(entry, &tok)
+	}
+	if err != nil {
+		if p.partial(entry, err) {
+			return entry, nil
+		}
+		return nil, err
+	}
+	return entry, nil
+}
+
+// ParseInto is like ParseNext, but parses the entry into e instead of
+// allocating a new one, which saves allocations in tight loops. It returns
+// false at the end of the stream.
+//
+// The Fields and Continuation slices of e are truncated and reused, so the
+// caller must copy them, e.g. by LogEntry.Clone, to retain them across calls.
+// The content of e is unspecified if an error is returned.
+func (p *StreamParser) ParseInto(e *LogEntry) (bool, error) {
+	if p.concurrencyCheck {
+		p.enter()
+		defer p.leave()
+	}
+	var tok Token
+	err := p.scanToken(&tok)
+	if err == nil && tok.Kind == TokenEOF {
+		return false, nil
+	}
+	*e = LogEntry{Fields: e.Fields[:0], Continuation: e.Continuation[:0]}
+	if err == nil {
+		err = p.parseEntry(e, &tok)
+	}
+	if err != nil {
+		if p.partial(e, err) {
+			return true, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// partial reports whether err is the end of the stream in the middle of e,
+// which is then marked as partial, with WithPartialEntries.
+func (p *StreamParser) partial(e *LogEntry, err error) bool {
+	if !p.partialEntries || !errors.Is(err, ErrIncompleteEntry) {
+		return false
+	}
+	e.Partial = true
+	return true
+}
+
+// parseEntry fills e with tok, the first token of an entry, and all the
+// following tokens up to the end of the entry.
+func (p *StreamParser) parseEntry(e *LogEntry, tok *Token) error {
+	for {
+		switch tok.Kind {
+		case TokenDatetime:
+			e.Header.DateTime = tok.DateTime
+			e.Header.OriginalOffset = tok.OriginalOffset
+		case TokenLevel:
+			e.Header.Level = tok.Level
+		case TokenFileLine:
+			e.Header.File = tok.File
+			e.Header.Line = tok.Line
+		case TokenMessage:
+			e.Message = tok.Text
+			e.MessageQuoted = tok.Quoted
+		case TokenField:
+			if p.warnFunc != nil {
+				for _, f := range e.Fields {
+					if f.Name == tok.Field.Name {
+						p.warn(fmt.Sprintf("duplicate field '%s'", f.Name))
+						break
+					}
+				}
+			}
+			e.Fields = append(e.Fields, tok.Field)
+		case TokenContinuation:
+			e.Continuation = append(e.Continuation, tok.Text)
+		case TokenSource:
+			e.Source = tok.Text
+		case TokenComment:
+			e.Comment = tok.Text
+		case TokenTrailer:
+			e.Trailer = tok.Text
+		case TokenEndOfEntry:
+			return nil
+		}
+		if err := p.scanToken(tok); err != nil {
+			return err
+		}
+	}
+}
+
+// reportBlankLines passes the number of blank lines skipped since the last
+// call to the function set by WithBlankLineFunc, if any.
+func (p *StreamParser) reportBlankLines() {
+	if p.blankLines > 0 && p.blankLineFunc != nil {
+		p.blankLineFunc(p.blankLines)
+	}
+	p.blankLines = 0
+}
+
+// warn reports a recoverable oddity at the current line, see
+// WithWarningFunc.
+func (p *StreamParser) warn(msg string) {
+	if p.warnFunc != nil {
+		p.warnFunc(p.line, msg)
+	}
+}
+
+// LevelCount returns the number of entries with level l parsed so far. It
+// can be used to sample the progress between calls to ParseNext.
+func (p *StreamParser) LevelCount(l LogLevel) int {
+	if l < LogLevelDebug || l > LogLevelFatal {
+		return 0
+	}
+	return p.levelCounts[l-LogLevelDebug]
+}
+
+// Progress returns the number of bytes consumed from the underlying
+// io.Reader, and the number of entries parsed so far. Together with the total
+// size of the input, it can be used to show the progress of a long parse.
+// Bytes read ahead into the buffer are not counted until the parser consumes
+// them, except in line buffer mode, where a whole line is consumed at once.
+func (p *StreamParser) Progress() (bytesRead int64, entriesParsed int) {
+	for _, n := range p.levelCounts {
+		entriesParsed += n
+	}
+	return p.counter.n - int64(p.src.Buffered()), entriesParsed
+}
+
+// Line returns the number of the line the parser is at, starting from 1.
+// After ParseNext, it is usually the last line of the entry. After an error,
+// it is the line the error occurred on, as in ParseError.Line.
+func (p *StreamParser) Line() int {
+	return p.line
+}
+
+// LineEnding returns the line ending of the stream seen first, "\n" or
+// "\r\n", or "" if no line has ended yet. See MixedLineEndings for whether
+// the other one was seen as well.
+func (p *StreamParser) LineEnding() string {
+	return p.lineEnding
+}
+
+// MixedLineEndings reports whether both "\n" and "\r\n" were seen as line
+// endings so far.
+func (p *StreamParser) MixedLineEndings() bool {
+	return p.mixedLineEndings
+}
+
+func (p *StreamParser) recordLineEnding(crlf bool) {
+	ending := "\n"
+	if crlf {
+		ending = "\r\n"
+	}
+	if p.lineEnding == "" {
+		p.lineEnding = ending
+	} else if p.lineEnding != ending {
+		p.mixedLineEndings = true
+	}
+}
+
+// countingReader counts the bytes read from r, see Progress. The counting
+// is done per read into the buffer, so the hot path is not affected.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	c.n += int64(n)
+	return n, err
+}
+
+// enter marks the parser as in use, and panics if it already is.
+func (p *StreamParser) enter() {
+	if !atomic.CompareAndSwapInt32(&p.busy, 0, 1) {
+		panic("logparser: concurrent use of a StreamParser")
+	}
+}
+
+// leave marks the parser as no longer in use.
+func (p *StreamParser) leave() {
+	atomic.StoreInt32(&p.busy, 0)
+}
+
+// ParseBatch parses up to n log entries. Fewer entries are returned without
+// error when the underlying io.Reader reaches io.EOF, so an empty slice means
+// there is nothing left. On failure, the entries parsed so far are returned
+// together with the error. If n <= 0, nothing is parsed and an empty slice is
+// returned.
+func (p *StreamParser) ParseBatch(n int) ([]*LogEntry, error) {
+	if n <= 0 {
+		return []*LogEntry{}, nil
+	}
+	entries := make([]*LogEntry, 0, n)
+	for len(entries) < n {
+		entry, err := p.ParseNext()
+		if err != nil {
+			return entries, err
+		}
+		if entry == nil {
+			break
+		}
 		entries = append(entries, entry)
 	}
-	return entries, nil
+	return entries, nil
+}
+
+// SkipLines consumes n lines without parsing them, e.g. to skip a banner
+// at the beginning of a log file. It should be called between entries,
+// usually before the first ParseNext. io.EOF is returned if the stream ends
+// before n lines are skipped; a last line without line break counts.
+func (p *StreamParser) SkipLines(n int) error {
+	for i := 0; i < n; i++ {
+		read := false
+		for {
+			b, err := p.br.ReadSlice('\n')
+			read = read || len(b) > 0
+			if err == bufio.ErrBufferFull {
+				continue
+			}
+			if err == nil {
+				p.newLine()
+				break
+			}
+			if err == io.EOF && read && i == n-1 {
+				return nil
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *StreamParser) wrapErr(stage string, cause error) error {
+	return &ParseError{
+		Line:    p.line,
+		Column:  p.column,
+		Stage:   stage,
+		Snippet: p.snippet(),
+		Err:     cause,
+	}
+}
+
+// DebugString returns a human-readable snapshot of the parser state for
+// diagnosing parse failures: the current line and column, the last stage
+// successfully parsed in the current entry, up to 32 upcoming bytes, and
+// the last datetime and log level tokens read. It does not advance the
+// reader, but should not be called in the middle of a read.
+func (p *StreamParser) DebugString() string {
+	n := 32
+	if n > p.br.Size() {
+		n = p.br.Size()
+	}
+	upcoming, _ := p.br.Peek(n)
+	return fmt.Sprintf("line=%d column=%d stage=%q upcoming=%q datetime=%q level=%q",
+		p.line, p.column, p.lastStage, upcoming,
+		p.datetimeBuf, p.levelBuf[:p.levelLen])
+}
+
+// maxSnippetLen is the maximum length of ParseError.Snippet in bytes.
+const maxSnippetLen = 256
+
+// readRune reads one rune and records it into lineBuf. All reads of the
+// parser should go through readRune and unreadRune.
+func (p *StreamParser) readRune() (rune, int, error) {
+	c, size, err := p.br.ReadRune()
+	if err != nil {
+		return c, size, err
+	}
+	if c == utf8.RuneError && size == 1 {
+		// A genuine U+FFFD is 3 bytes long.
+		return c, size, fmt.Errorf("invalid or truncated UTF-8 at line %d", p.line)
+	}
+	if len(p.lineBuf) >= 2*maxSnippetLen {
+		n := copy(p.lineBuf, p.lineBuf[len(p.lineBuf)-maxSnippetLen:])
+		p.lineBuf = p.lineBuf[:n]
+	}
+	n := len(p.lineBuf)
+	p.lineBuf = appendRune(p.lineBuf, c)
+	p.lastRuneSize = len(p.lineBuf) - n
+	if p.captureRaw {
+		p.rawBuf = append(p.rawBuf, p.lineBuf[n:]...)
+	}
+	p.column++
+	p.lastSize = 0
+	if c != '\n' && c != '\r' {
+		p.lastSize = size
+		p.lineLen += size
+		if p.maxLineLength > 0 && p.lineLen > p.maxLineLength {
+			return c, size, p.lineTooLong()
+		}
+	}
+	return c, size, nil
+}
+
+func (p *StreamParser) unreadRune() error {
+	if err := p.br.UnreadRune(); err != nil {
+		return err
+	}
+	p.lineBuf = p.lineBuf[:len(p.lineBuf)-p.lastRuneSize]
+	if p.captureRaw {
+		p.rawBuf = p.rawBuf[:len(p.rawBuf)-p.lastRuneSize]
+	}
+	p.lastRuneSize = 0
+	p.column--
+	p.lineLen -= p.lastSize
+	p.lastSize = 0
+	return nil
+}
+
+// loadLine reads the current line, without the line break, into lineStr
+// and makes br read from it. It is used in line buffer mode.
+func (p *StreamParser) loadLine() error {
+	p.lineBytes = p.lineBytes[:0]
+	for {
+		b, err := p.src.ReadSlice('\n')
+		p.lineBytes = append(p.lineBytes, b...)
+		if p.maxLineLength > 0 && len(bytes.TrimRight(p.lineBytes, "\r\n")) > p.maxLineLength {
+			return p.lineTooLong()
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if err == nil {
+			// Leave the line break to trimNewLines.
+			p.lineBytes = p.lineBytes[:len(p.lineBytes)-1]
+			if err := p.src.UnreadByte(); err != nil {
+				return err
+			}
+			if n := len(p.lineBytes); n > 0 && p.lineBytes[n-1] == '\r' {
+				p.lineBytes = p.lineBytes[:n-1]
+				// The '\r' is consumed already, see trimNewLines.
+				p.lineCR = true
+			}
+		}
+		break
+	}
+	p.lineStr = string(p.lineBytes)
+	p.lineSrc.Reset(p.lineStr)
+	if p.lineBr == nil {
+		p.lineBr = bufio.NewReader(&p.lineSrc)
+	} else {
+		p.lineBr.Reset(&p.lineSrc)
+	}
+	p.br = p.lineBr
+	p.lineLoaded = true
+	return nil
+}
+
+// unloadLine makes br read from the underlying io.Reader again.
+func (p *StreamParser) unloadLine() {
+	p.br = p.src
+	p.lineLoaded = false
+}
+
+// linePos returns the byte offset of the next rune to read in lineStr,
+// or 0 if no line is loaded.
+func (p *StreamParser) linePos() int {
+	if !p.lineLoaded {
+		return 0
+	}
+	return len(p.lineStr) - p.lineSrc.Len() - p.lineBr.Buffered()
+}
+
+// lineTooLong returns the error for a line exceeding the limit set by
+// WithMaxLineLength.
+func (p *StreamParser) lineTooLong() error {
+	return fmt.Errorf("line %d exceeds the maximum length of %d bytes", p.line, p.maxLineLength)
+}
+
+// newLine is called after a line break is consumed.
+func (p *StreamParser) newLine() {
+	p.line++
+	p.lineBuf = p.lineBuf[:0]
+	p.column = 0
+	p.lineLen = 0
+}
+
+// snippet returns the last bytes read from the current line.
+func (p *StreamParser) snippet() string {
+	b := p.lineBuf
+	if len(b) > maxSnippetLen {
+		b = b[len(b)-maxSnippetLen:]
+		// Do not start in the middle of a rune.
+		for len(b) > 0 && !utf8.RuneStart(b[0]) {
+			b = b[1:]
+		}
+	}
+	return string(b)
+}
+
+// utf8BOM is the UTF-8 encoded byte order mark.
+var utf8BOM = []byte{0xef, 0xbb, 0xbf}
+
+// skipBOM consumes the byte order mark at the start of the stream, if any.
+func (p *StreamParser) skipBOM() error {
+	if b, _ := p.src.Peek(1); len(b) == 0 || b[0] != utf8BOM[0] {
+		return nil
+	}
+	if b, _ := p.src.Peek(len(utf8BOM)); !bytes.Equal(b, utf8BOM) {
+		return nil
+	}
+	_, err := p.src.Discard(len(utf8BOM))
+	return err
+}
+
+func (p *StreamParser) skipChar(expect rune) error {
+	c, _, err := p.readRune()
+	if err != nil {
+		return err
+	}
+	if c != expect {
+		return fmt.Errorf("expect '%c' but found '%c'", expect, c)
+	}
+	return nil
+}
+
+func (p *StreamParser) trimChar(skip rune) error {
+	for {
+		c, _, err := p.readRune()
+		if err != nil {
+			return err
+		}
+		if c != skip {
+			return p.unreadRune()
+		}
+	}
+}
+
+// skipSeparator consumes the separator between two tokens, which is a
+// single space, or any run of spaces and tabs with WithFlexibleWhitespace.
+func (p *StreamParser) skipSeparator() error {
+	if !p.flexibleWhitespace {
+		return p.skipChar(' ')
+	}
+	c, _, err := p.readRune()
+	if err != nil {
+		return err
+	}
+	if c != ' ' && c != '\t' {
+		return fmt.Errorf("expect whitespace but found '%c'", c)
+	}
+	return p.trimSpaces()
+}
+
+// trimSpaces skips spaces, and tabs as well with WithFlexibleWhitespace.
+func (p *StreamParser) trimSpaces() error {
+	if !p.flexibleWhitespace {
+		return p.trimChar(' ')
+	}
+	for {
+		c, _, err := p.readRune()
+		if err != nil {
+			return err
+		}
+		if c != ' ' && c != '\t' {
+			return p.unreadRune()
+		}
+	}
+}
+
+func (p *StreamParser) trimNewLines() error {
+	for {
+		// Nothing is read from a blank line before its line break.
+		blank := p.column == 0
+		c, _, err := p.readRune()
+		if err != nil {
+			return err
+		}
+		crlf := c == '\r'
+		if crlf {
+			c, _, err = p.readRune()
+			if err != nil {
+				return err
+			}
+			if c != '\n' {
+				return fmt.Errorf("expect '\\n' but found '%c'", c)
+			}
+		}
+		if c != '\n' {
+			return p.unreadRune()
+		}
+		p.recordLineEnding(crlf || p.lineCR)
+		p.lineCR = false
+		p.newLine()
+		if blank {
+			p.blankLines++
+		}
+	}
+}
+
+func (p *StreamParser) parseDatetime() (time.Time, error) {
+	if p.unbracketedDatetime {
+		return p.parseUnbracketedDatetime()
+	}
+	if err := p.skipChar('['); err != nil {
+		return time.Time{}, err
+	}
+	p.datetimeBuf = p.datetimeBuf[:0]
+	for {
+		c, _, err := p.readRune()
+		if err != nil {
+			return time.Time{}, err
+		}
+		if c == ']' {
+			break
+		}
+		if err := p.appendDatetimeChar(c); err != nil {
+			return time.Time{}, err
+		}
+	}
+	return p.parseDatetimeToken(string(p.datetimeBuf))
+}
+
+// parseUnbracketedDatetime reads a datetime without brackets, which
+// extends to the space before the '[' of the level, or to any run of spaces
+// and tabs with WithFlexibleWhitespace, see WithUnbracketedDatetime.
+func (p *StreamParser) parseUnbracketedDatetime() (time.Time, error) {
+	p.datetimeBuf = p.datetimeBuf[:0]
+	for {
+		b, err := p.br.Peek(2)
+		if len(b) == 2 && b[0] == ' ' && b[1] == '[' {
+			break
+		}
+		if len(b) == 0 {
+			return time.Time{}, err
+		}
+		if p.flexibleWhitespace && (b[0] == ' ' || b[0] == '\t') {
+			end, err := p.peekTokenEnd()
+			if err != nil {
+				return time.Time{}, err
+			}
+			if end {
+				break
+			}
+		}
+		c, _, err := p.readRune()
+		if err != nil {
+			return time.Time{}, err
+		}
+		if err := p.appendDatetimeChar(c); err != nil {
+			return time.Time{}, err
+		}
+	}
+	return p.parseDatetimeToken(string(p.datetimeBuf))
+}
+
+// appendDatetimeChar appends c to datetimeBuf, if it is valid in a
+// datetime.
+func (p *StreamParser) appendDatetimeChar(c rune) error {
+	if len(p.datetimeBuf) >= maxDatetimeLen {
+		return errors.New("datetime too long")
+	}
+	if p.datetimeParser != nil {
+		// Anything but a line break is left to the custom parser.
+		if c == '\n' || c == '\r' {
+			return fmt.Errorf("unexpected character '%c'", c)
+		}
+		p.datetimeBuf = appendRune(p.datetimeBuf, c)
+		return nil
+	}
+	if c == ',' && p.commaFractionalSeconds && len(p.datetimeBuf) == datetimeFractionPos {
+		c = '.'
+	} else if !validDatetimeChar(c) {
+		return fmt.Errorf("unexpected character '%c'", c)
+	}
+	p.datetimeBuf = append(p.datetimeBuf, byte(c))
+	return nil
+}
+
+// maxDatetimeLen is the maximum length of a datetime token in bytes, which
+// bounds the growth of datetimeBuf on malformed input.
+const maxDatetimeLen = 128
+
+func (p *StreamParser) parseLogLevel() (LogLevel, error) {
+	if err := p.skipChar('['); err != nil {
+		return -1, err
+	}
+	// The level may be padded with spaces, like `[ INFO ]`.
+	if err := p.trimChar(' '); err != nil {
+		return -1, err
+	}
+	n := 0
+	for {
+		c, _, err := p.readRune()
+		if err != nil {
+			return -1, err
+		}
+		if c == ' ' {
+			if err := p.trimChar(' '); err != nil {
+				return -1, err
+			}
+			if err := p.skipChar(']'); err != nil {
+				return -1, err
+			}
+			break
+		}
+		if c == ']' {
+			break
+		}
+		if !validLogLevelChar(c) {
+			return -1, fmt.Errorf("unexpected character '%c'", c)
+		}
+		if n >= len(p.levelBuf) {
+			return -1, errors.New("log level too long")
+		}
+		p.levelBuf[n] = byte(c)
+		n++
+	}
+	p.levelLen = n
+	level, err := p.resolveLogLevel(p.levelBuf[:n])
+	if err == nil && p.warnFunc != nil && !isUpper(p.levelBuf[:n]) {
+		p.warn(fmt.Sprintf("log level '%s' is not upper case", p.levelBuf[:n]))
+	}
+	return level, err
+}
+
+// maxLogLevelLen is the maximum length of a log level in bytes, which is
+// enough for aliases like `CRITICAL`, see WithLevelAliases.
+const maxLogLevelLen = 16
+
+// resolveLogLevel converts the log level b, looking up the aliases set by
+// WithLevelAliases first.
+func (p *StreamParser) resolveLogLevel(b []byte) (LogLevel, error) {
+	if p.levelAliases != nil {
+		var upper [maxLogLevelLen]byte
+		for i, c := range b {
+			if c >= 'a' && c <= 'z' {
+				c -= 'a' - 'A'
+			}
+			upper[i] = c
+		}
+		// The conversion in the map index does not allocate.
+		if level, ok := p.levelAliases[string(upper[:len(b)])]; ok {
+			if level < LogLevelDebug || level > LogLevelFatal {
+				return LogLevelInfo, fmt.Errorf("log level '%s' is an alias of the invalid level %v", b, level)
+			}
+			return level, nil
+		}
+	}
+	return StringToLogLevel(string(b))
+}
+
+// maxFileLinePeek is the most bytes hasFileLine looks ahead.
+const maxFileLinePeek = 512
+
+// unknownFileLine is the file:line of an entry without a known source, after
+// the opening bracket.
+const unknownFileLine = "<unknown>]"
+
+// hasFileLine peeks the next token and reports whether it looks like a
+// file:line, i.e. `[<unknown>]`, or `[name:digits]` where the name only has
+// valid file name characters. If the token is longer than maxFileLinePeek
+// and nothing disagrees so far, it is assumed to be a file:line.
+func (p *StreamParser) hasFileLine() bool {
+	b, _ := p.peekUntil(maxFileLinePeek, func(b []byte) bool {
+		return (len(b) > 0 && b[0] != '[') || bytes.IndexAny(b, "]\r\n") >= 0
+	})
+	if len(b) > 0 && b[0] != '[' && (p.unbracketedMessage || p.msgOpen != '[') {
+		return false
+	}
+	if len(b) < 2 || b[0] != '[' {
+		// Let parseFileLine report the error.
+		return true
+	}
+	if b[1] == '<' {
+		// A message like `[<b>]` is not a file:line. A look-ahead shorter
+		// than `[<unknown>]` is assumed to be one if it agrees so far.
+		rest := b[1:]
+		if len(rest) > len(unknownFileLine) {
+			rest = rest[:len(unknownFileLine)]
+		}
+		return strings.HasPrefix(unknownFileLine, string(rest))
+	}
+	sep := -1
+	for i := 1; i < len(b); i++ {
+		c := b[i]
+		switch {
+		case c == ']':
+			return sep > 1 && sep < i-1
+		case c == ':':
+			sep = i
+		case sep >= 0 && validLineNumberChar(rune(c)):
+		case validFilenameChar(rune(c)):
+			// A ':' followed by non-digits is part of the file name.
+			sep = -1
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// peekField peeks the next token and reports whether it is a field, i.e. it
+// starts with '[' and has the field separator outside of quotes before the
+// closing ']'. A token longer than the read buffer is assumed to be a message.
+func (p *StreamParser) peekField() bool {
+	var field bool
+	_, _ = p.peekUntil(p.br.Size(), func(b []byte) bool {
+		var done bool
+		field, done = p.scanField(b)
+		return done
+	})
+	return field
+}
+
+// scanField reports whether the token at the start of b is a field, see
+// peekField, and whether b is long enough to tell.
+func (p *StreamParser) scanField(b []byte) (field bool, done bool) {
+	if len(b) == 0 {
+		return false, false
+	}
+	if b[0] != '[' {
+		return false, true
+	}
+	var sep [utf8.UTFMax]byte
+	n := utf8.EncodeRune(sep[:], p.fieldSep)
+	quoted := false
+	for i := 1; i < len(b); i++ {
+		c := b[i]
+		switch {
+		case c == '\\':
+			// Skip the escaped character.
+			i++
+		case c == '"':
+			quoted = !quoted
+		case quoted:
+		case c == ']' || c == '\n':
+			return false, true
+		case bytes.HasPrefix(b[i:], sep[:n]):
+			return true, true
+		}
+	}
+	return false, false
+}
+
+func (p *StreamParser) parseFileLine() (string, int, error) {
+	if err := p.skipChar('['); err != nil {
+		return "", 0, err
+	}
+	c, _, err := p.readRune()
+	if err != nil {
+		return "", 0, err
+	}
+	if c == '<' {
+		// [<unknown>]
+		for {
+			c, _, err := p.readRune()
+			if err != nil {
+				return "", 0, err
+			}
+			if c == ']' {
+				break
+			}
+			if !((c >= 'a' && c <= 'z') || c == '<' || c == '>') {
+				return "", 0, fmt.Errorf("unexpected character '%c'", c)
+			}
+		}
+		return "", 0, nil
+	} else {
+		if err := p.unreadRune(); err != nil {
+			return "", 0, err
+		}
+	}
+	// [file:line]
+	// The file name may contain ':' as well, e.g. a Windows path with drive
+	// letter, so the last ':' is the separator of the file name and the line.
+	token := p.fileLineBuf[:0]
+	sep := -1
+	for {
+		c, _, err := p.readRune()
+		if err != nil {
+			return "", 0, err
+		}
+		if c == ']' {
+			break
+		}
+		if c == ':' {
+			sep = len(token)
+		} else if !validFilenameChar(c) {
+			return "", 0, fmt.Errorf("unexpected character '%c'", c)
+		}
+		token = appendRune(token, c)
+	}
+	p.fileLineBuf = token
+	if sep < 0 || sep == len(token)-1 {
+		return "", 0, fmt.Errorf("missing line number in '%s'", token)
+	}
+	line := token[sep+1:]
+	for _, c := range string(line) {
+		if !validLineNumberChar(c) {
+			return "", 0, fmt.Errorf("unexpected character '%c'", c)
+		}
+	}
+	lineNum, err := strconv.Atoi(string(line))
+	if err != nil {
+		// Only digits are left, but the number may overflow.
+		if errors.Is(err, strconv.ErrRange) {
+			return "", 0, fmt.Errorf("line number out of range: %w", err)
+		}
+		return "", 0, err
+	}
+	return string(token[:sep]), lineNum, nil
+}
+
+func (p *StreamParser) parseMessage() (string, error) {
+	if p.unbracketedMessage {
+		b, err := p.br.Peek(utf8.RuneLen(p.msgOpen))
+		if err != nil && err != io.EOF {
+			return "", err
+		}
+		if c, _ := utf8.DecodeRune(b); c != p.msgOpen {
+			p.literalQuoted = false
+			return p.parseUnbracketedMessage()
+		}
+	}
+	if err := p.skipChar(p.msgOpen); err != nil {
+		return "", err
+	}
+	r, err := p.parseStringLiteral(literalMessage)
+	if err != nil {
+		return "", err
+	}
+	if err := p.skipChar(p.msgClose); err != nil {
+		return "", err
+	}
+	return r, nil
+}
+
+// parseUnbracketedMessage reads a message which is not enclosed in brackets.
+// The message ends right before the line break, or right before the first
+// space that is followed by '[', which is where the fields begin. Trailing
+// spaces are not part of the message. With WithFlexibleWhitespace, it also
+// ends before a run of spaces and tabs followed by '[' or the line break.
+func (p *StreamParser) parseUnbracketedMessage() (string, error) {
+	limit := p.literalLimit(literalMessage)
+	var literal []rune
+	for {
+		b, err := p.br.Peek(2)
+		if len(b) == 0 {
+			if err == io.EOF {
+				break
+			}
+			return "", err
+		}
+		if b[0] == '\n' || b[0] == '\r' || (len(b) == 2 && b[0] == ' ' && b[1] == '[') {
+			break
+		}
+		if p.flexibleWhitespace && (b[0] == ' ' || b[0] == '\t') {
+			end, err := p.peekTokenEnd()
+			if err != nil {
+				return "", err
+			}
+			if end {
+				break
+			}
+		}
+		c, _, err := p.readRune()
+		if err != nil {
+			return "", err
+		}
+		if isControlChar(c) {
+			r, err := p.controlChar(c)
+			if err != nil {
+				return "", err
+			}
+			if r < 0 {
+				continue
+			}
+			c = r
+		}
+		if limit > 0 && len(literal) >= limit {
+			return "", fmt.Errorf("message too long, limit is %d", limit)
+		}
+		literal = append(literal, c)
+	}
+	return strings.TrimRight(string(literal), " "), nil
+}
+
+// peekTokenEnd reports whether the next runes are a run of spaces and tabs
+// followed by '[', a line break or the end of input, which ends an
+// unbracketed datetime or message with WithFlexibleWhitespace.
+func (p *StreamParser) peekTokenEnd() (bool, error) {
+	b, err := p.peekUntil(p.br.Size(), func(b []byte) bool {
+		return len(bytes.TrimLeft(b, " \t")) > 0
+	})
+	if err != nil {
+		return false, err
+	}
+	rest := bytes.TrimLeft(b, " \t")
+	return len(rest) == 0 || rest[0] == '[' || rest[0] == '\n' || rest[0] == '\r', nil
+}
+
+// parseComment reads the trailing comment after the fields up to the end of
+// the line, if the line continues with the comment prefix. The comment is
+// returned without the prefix and surrounding spaces.
+func (p *StreamParser) parseComment() (string, bool, error) {
+	b, err := p.br.Peek(len(p.commentPrefix))
+	if string(b) != p.commentPrefix {
+		if err != nil && err != io.EOF {
+			return "", false, err
+		}
+		return "", false, nil
+	}
+	for n := 0; n < len(p.commentPrefix); {
+		_, size, err := p.readRune()
+		if err != nil {
+			return "", false, err
+		}
+		n += size
+	}
+	comment, err := p.readRestOfLine()
+	if err != nil {
+		return "", false, err
+	}
+	return strings.TrimSpace(comment), true, nil
+}
+
+// parseTrailer handles the text after the fields up to the end of the line,
+// if any, as set by WithTrailingTokenPolicy. It reports whether the text is
+// captured as a trailer.
+func (p *StreamParser) parseTrailer() (string, bool, error) {
+	c, _, err := p.readRune()
+	if err == io.EOF {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	if c == '\n' || c == '\r' {
+		return "", false, p.unreadRune()
+	}
+	if p.trailingTokenPolicy == TrailingTokenReject {
+		return "", false, fmt.Errorf("unexpected character '%c'", c)
+	}
+	if err := p.unreadRune(); err != nil {
+		return "", false, err
+	}
+	trailer, err := p.readRestOfLine()
+	if err != nil {
+		return "", false, err
+	}
+	if p.trailingTokenPolicy != TrailingTokenCapture {
+		if p.warnFunc != nil {
+			p.warn(fmt.Sprintf("trailing text '%s' is skipped", strings.TrimRight(trailer, " \t")))
+		}
+		return "", false, nil
+	}
+	return strings.TrimRight(trailer, " \t"), true, nil
+}
+
+// readRestOfLine reads the rest of the current line, without the line break.
+func (p *StreamParser) readRestOfLine() (string, error) {
+	var literal []rune
+	for {
+		c, _, err := p.readRune()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		if c == '\n' || c == '\r' {
+			if err := p.unreadRune(); err != nil {
+				return "", err
+			}
+			break
+		}
+		literal = append(literal, c)
+	}
+	return string(literal), nil
+}
+
+// parseContinuation reads the next line following an entry, skipping empty
+// lines, and reports false if it starts a new entry or there is nothing left.
+// For the first line, nothing is read if the entry line does not end.
+func (p *StreamParser) parseContinuation(first bool) (string, bool, error) {
+	if first {
+		if b, _ := p.br.Peek(1); len(b) == 0 || (b[0] != '\n' && b[0] != '\r') {
+			return "", false, nil
+		}
+	}
+	if err := p.trimNewLines(); err != nil {
+		if err == io.EOF {
+			return "", false, nil
+		}
+		return "", false, err
+	}
+	start, err := p.isEntryStart()
+	if err != nil || start {
+		return "", false, err
+	}
+	line, err := p.readLine()
+	if err != nil {
+		return "", false, err
+	}
+	// The blank lines before a continuation line are not reported.
+	p.blankLines = 0
+	return line, true, nil
+}
+
+// startsWithDatetime reports whether b starts like a datetime, that is '['
+// followed by a digit, or only a digit with WithUnbracketedDatetime.
+func (p *StreamParser) startsWithDatetime(b []byte) bool {
+	if p.unbracketedDatetime {
+		return len(b) >= 1 && b[0] >= '0' && b[0] <= '9'
+	}
+	return len(b) >= 2 && b[0] == '[' && b[1] >= '0' && b[1] <= '9'
+}
+
+// parseLinePrefix consumes the text matched by the line prefix pattern at the
+// beginning of the line, if any, and returns it without trailing spaces.
+func (p *StreamParser) parseLinePrefix() (string, bool, error) {
+	line, err := p.peekLine()
+	if err != nil {
+		return "", false, err
+	}
+	loc := p.linePrefix.FindIndex(line)
+	if loc == nil || loc[0] != 0 || loc[1] == 0 {
+		return "", false, nil
+	}
+	source := strings.TrimRight(string(line[:loc[1]]), " ")
+	for n := 0; n < loc[1]; {
+		_, size, err := p.readRune()
+		if err != nil {
+			return "", false, err
+		}
+		n += size
+	}
+	return source, true, nil
+}
+
+// peekUntil peeks at most max bytes ahead, or less if done reports that the
+// bytes peeked so far are enough. It only waits for more input than is
+// buffered while done asks for it, so that it does not block on a stream
+// which is still being written, like in FollowParser.
+func (p *StreamParser) peekUntil(max int, done func(b []byte) bool) ([]byte, error) {
+	if max > p.br.Size() {
+		max = p.br.Size()
+	}
+	n := p.br.Buffered()
+	for {
+		if n < 1 {
+			n = 1
+		}
+		if n > max {
+			n = max
+		}
+		b, err := p.br.Peek(n)
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		if done(b) || err != nil || n == max {
+			return b, nil
+		}
+		// Wait for one more byte, or take whatever the read brought in.
+		n = len(b) + 1
+		if m := p.br.Buffered(); m > n {
+			n = m
+		}
+	}
+}
+
+// peekLine returns the rest of the current line without the line break, as
+// far as it fits into the buffer. It does not advance the reader.
+func (p *StreamParser) peekLine() ([]byte, error) {
+	b, err := p.peekUntil(p.br.Size(), func(b []byte) bool {
+		return bytes.IndexAny(b, "\r\n") >= 0
+	})
+	if i := bytes.IndexAny(b, "\r\n"); i >= 0 {
+		b = b[:i]
+	}
+	return b, err
+}
+
+// isEntryStart peeks the next line and reports whether it starts a new log
+// entry, that is, '[' followed by a digit after optional spaces, see
+// startsWithDatetime.
+func (p *StreamParser) isEntryStart() (bool, error) {
+	if p.linePrefix != nil {
+		line, err := p.peekLine()
+		if err != nil {
+			return false, err
+		}
+		return p.lineStartsEntry(line), nil
+	}
+	for n := 2; ; n *= 2 {
+		if n > p.br.Size() {
+			n = p.br.Size()
+		}
+		b, err := p.br.Peek(n)
+		i := 0
+		for i < len(b) && b[i] == ' ' {
+			i++
+		}
+		if i+1 < len(b) || (i < len(b) && b[i] != '[') {
+			return p.startsWithDatetime(b[i:]), nil
+		}
+		if err == io.EOF || err == bufio.ErrBufferFull || n == p.br.Size() {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+	}
+}
+
+// lineStartsEntry reports whether line starts a new log entry, that is, the
+// datetime follows optional spaces and the line prefix, see
+// startsWithDatetime.
+func (p *StreamParser) lineStartsEntry(line []byte) bool {
+	line = bytes.TrimLeft(line, " ")
+	if p.linePrefix != nil {
+		if loc := p.linePrefix.FindIndex(line); loc != nil && loc[0] == 0 {
+			line = bytes.TrimLeft(line[loc[1]:], " ")
+		}
+	}
+	return p.startsWithDatetime(line)
 }
 
-// StreamParser is a parser implementation which parses bytes from
-// io.Reader into individual *LogEntry. Users can parse large log files
-// on demand without having to read them all into memory at once.
-type StreamParser struct {
-	br          *bufio.Reader
-	line        int
-	datetimeBuf [30]byte
-	levelBuf    [5]byte
+// readLine reads the rest of the current line, without the line break.
+func (p *StreamParser) readLine() (string, error) {
+	var line []byte
+	for {
+		b, err := p.br.ReadSlice('\n')
+		line = append(line, b...)
+		if p.maxLineLength > 0 && len(bytes.TrimRight(line, "\r\n")) > p.maxLineLength {
+			return "", p.lineTooLong()
+		}
+		switch err {
+		case bufio.ErrBufferFull:
+			continue
+		case nil:
+			line = line[:len(line)-1]
+			crlf := bytes.HasSuffix(line, []byte{'\r'})
+			if crlf {
+				line = line[:len(line)-1]
+			}
+			p.recordLineEnding(crlf)
+			p.newLine()
+			return string(line), nil
+		case io.EOF:
+			return string(line), nil
+		default:
+			return "", err
+		}
+	}
 }
 
-// NewStreamParser creates new *StreamParser associated with the io.Reader.
-func NewStreamParser(r io.Reader) *StreamParser {
-	return &StreamParser{
-		br:   bufio.NewReader(r),
-		line: 1,
+func (p *StreamParser) parseFields() ([]LogField, error) {
+	var fields []LogField
+	p.fieldCount = 0
+	for {
+		ok, err := p.nextField()
+		if err != nil || !ok {
+			return fields, err
+		}
+		field, err := p.parseField()
+		if err != nil {
+			return nil, err
+		}
+		fields = append(fields, field)
+		p.fieldCount++
 	}
 }
 
-// ParseNext reads and parses one LogEntry from bufio.Reader on demand.
-// This function will return (nil, nil) if the underlying io.Reader returns
-// io.EOF in the standard case.
-func (p *StreamParser) ParseNext() (*LogEntry, error) {
-	// Skip empty lines.
-	if err := p.trimNewLines(); err != nil {
+// nextField skips spaces and consumes the '[' of the next field, if any.
+func (p *StreamParser) nextField() (bool, error) {
+	if err := p.trimSpaces(); err != nil {
 		if err == io.EOF {
-			return nil, nil
+			return false, nil
 		}
-		return nil, p.wrapErr(err)
-	}
-	// Skip spaces at the beginning of the line.
-	if err := p.trimChar(' '); err != nil {
-		return nil, p.wrapErr(err)
+		return false, err
 	}
-	// Parse datetime.
-	datetime, err := p.parseDatetime()
+	p.beginRaw()
+	c, _, err := p.readRune()
 	if err != nil {
-		return nil, p.wrapErr(err)
+		return false, err
+	}
+	if c != '[' {
+		return false, p.unreadRune()
 	}
-	// Skip one space.
-	if err := p.skipChar(' '); err != nil {
-		return nil, p.wrapErr(err)
+	if p.maxFields > 0 && p.fieldCount >= p.maxFields {
+		return false, fmt.Errorf("too many fields, limit is %d", p.maxFields)
 	}
-	// Parse log level.
-	level, err := p.parseLogLevel()
+	return true, nil
+}
+
+// parseField parses one field after its '['.
+func (p *StreamParser) parseField() (LogField, error) {
+	name, err := p.parseStringLiteral(literalFieldName)
 	if err != nil {
-		return nil, p.wrapErr(err)
+		return LogField{}, err
 	}
-	// Skip one space.
-	if err := p.skipChar(' '); err != nil {
-		return nil, p.wrapErr(err)
+	if p.fieldNameTransform != nil {
+		name = p.fieldNameTransform(name)
 	}
-	// Parse file:line.
-	filename, line, err := p.parseFileLine()
-	if err != nil {
-		return nil, p.wrapErr(err)
+	// A separator other than '=' may be surrounded by spaces, like `[k: v]`.
+	spaced := p.fieldSep != '='
+	if spaced {
+		if err := p.trimSpaces(); err != nil {
+			return LogField{}, err
+		}
 	}
-	// Skip one space.
-	if err := p.skipChar(' '); err != nil {
-		return nil, p.wrapErr(err)
+	if err := p.skipChar(p.fieldSep); err != nil {
+		return LogField{}, err
 	}
-	// Parse message.
-	message, err := p.parseMessage()
-	if err != nil {
-		return nil, p.wrapErr(err)
+	if spaced {
+		if err := p.trimSpaces(); err != nil {
+			return LogField{}, err
+		}
 	}
-	// Parse fields.
-	fields, err := p.parseFields()
+	value, err := p.parseStringLiteral(literalFieldValue)
 	if err != nil {
-		return nil, p.wrapErr(err)
-	}
-	// Skip spaces at the end of the line.
-	if err := p.trimChar(' '); err != nil && err != io.EOF {
-		return nil, p.wrapErr(err)
-	}
-	return &LogEntry{
-		Header: LogHeader{
-			DateTime: datetime,
-			Level:    level,
-			File:     filename,
-			Line:     line,
-		},
-		Message: message,
-		Fields:  fields,
+		return LogField{}, err
+	}
+	quoted := p.literalQuoted
+	if err := p.skipChar(']'); err != nil {
+		return LogField{}, err
+	}
+	return LogField{
+		Name:        name,
+		Value:       value,
+		ValueQuoted: quoted,
 	}, nil
 }
 
-func (p *StreamParser) wrapErr(cause error) error {
-	return fmt.Errorf("invalid log format at line %d, cause: %v", p.line, cause)
+// literalKind tells which part of a log entry a string literal belongs to.
+type literalKind int
+
+const (
+	literalMessage literalKind = iota
+	literalFieldName
+	literalFieldValue
+)
+
+// literalLimit returns the maximum number of runes allowed for a string
+// literal of the given kind, or 0 if unlimited.
+func (p *StreamParser) literalLimit(kind literalKind) int {
+	if kind == literalMessage {
+		return p.maxMessageLen
+	}
+	return 0
 }
 
-func (p *StreamParser) skipChar(expect rune) error {
-	c, _, err := p.br.ReadRune()
+// TODO: optimize
+func (p *StreamParser) parseStringLiteral(kind literalKind) (string, error) {
+	c, _, err := p.readRune()
 	if err != nil {
-		return err
+		return "", err
 	}
-	if c != expect {
-		return fmt.Errorf("expect '%c' but found '%c'", expect, c)
+	if err := p.unreadRune(); err != nil {
+		return "", err
 	}
-	return nil
-}
-
-func (p *StreamParser) trimChar(skip rune) error {
-	for {
-		c, _, err := p.br.ReadRune()
-		if err != nil {
-			return err
-		}
-		if c != skip {
-			return p.br.UnreadRune()
+	intern := kind == literalFieldName && p.internNames
+	p.literalQuoted = c == '"'
+	if c == '"' {
+		s, err := p.parseStringJson(kind)
+		if err == nil && intern {
+			s = p.internString(s)
 		}
+		return s, err
 	}
-}
-
-func (p *StreamParser) trimNewLines() error {
-	for {
-		c, _, err := p.br.ReadRune()
+	if kind == literalFieldValue && (c == '{' || c == '[') {
+		json, err := p.peekJSONValue()
 		if err != nil {
-			return err
-		}
-		if c == '\r' {
-			c, _, err = p.br.ReadRune()
-			if err != nil {
-				return err
-			}
-			if c != '\n' {
-				return fmt.Errorf("expect '\\n' but found '%c'", c)
-			}
+			return "", err
 		}
-		if c != '\n' {
-			return p.br.UnreadRune()
+		if json {
+			return p.parseJSONValue()
 		}
-		p.line++
 	}
-}
-
-func (p *StreamParser) parseDatetime() (time.Time, error) {
-	if err := p.skipChar('['); err != nil {
-		return time.Time{}, err
+	limit := p.literalLimit(kind)
+	start := p.linePos()
+	valid := validStringLiteralChar
+	if kind == literalFieldValue && p.valueValidator != nil {
+		valid = p.valueValidator
 	}
-	n := 0
-	for {
-		c, _, err := p.br.ReadRune()
+	balanced := kind == literalFieldValue && p.bracketBalancedBareValues
+	depth := 0
+	// A greedy value extends to the closing bracket, spaces included, if
+	// there is no other field on the line.
+	greedy := false
+	if kind == literalFieldValue && p.lastFieldGreedy {
+		line, err := p.peekLine()
 		if err != nil {
-			return time.Time{}, err
-		}
-		if c == ']' {
-			break
-		}
-		if !validDatetimeChar(c) {
-			return time.Time{}, fmt.Errorf("unexpected character '%c'", c)
-		}
-		if n >= len(p.datetimeBuf) {
-			return time.Time{}, errors.New("datetime too long")
+			return "", err
 		}
-		p.datetimeBuf[n] = byte(c)
-		n++
+		greedy = bytes.IndexByte(line, '[') < 0
 	}
-	return time.Parse("2006/01/02 15:04:05.000 -07:00", string(p.datetimeBuf[:n]))
-}
-
-func (p *StreamParser) parseLogLevel() (LogLevel, error) {
-	if err := p.skipChar('['); err != nil {
-		return -1, err
+	// In line buffer mode, the literal is sliced from the line, unless it
+	// has to be built for an escaped separator.
+	build := !p.lineLoaded
+	literal := p.literalBuf[:0]
+	if intern {
+		literal = p.internBuf[:0]
 	}
-	n := 0
-	for {
-		c, _, err := p.br.ReadRune()
+	for n := 0; ; n++ {
+		c, _, err := p.readRune()
 		if err != nil {
-			return -1, err
+			return "", err
 		}
-		if c == ']' {
+		if isControlChar(c) {
+			r, err := p.controlChar(c)
+			if err != nil {
+				return "", err
+			}
+			if !build {
+				build = true
+				literal = append(literal, p.lineStr[start:p.linePos()-1]...)
+			}
+			if r < 0 {
+				continue
+			}
+			c = r
+		} else if c == '\\' && (kind != literalMessage || p.bracketEscaping) {
+			// A backslash escapes the separator in a field, like `[a\=b=c]`,
+			// and a bracket in a message or value with WithBracketEscaping.
+			if sep, ok := p.peekEscaped(kind); ok {
+				if !build {
+					build = true
+					literal = append(literal, p.lineStr[start:p.linePos()-1]...)
+				}
+				if _, _, err := p.readRune(); err != nil {
+					return "", err
+				}
+				c = sep
+			}
+		} else if greedy {
+			if c == ']' || c == '\n' || c == '\r' {
+				if err := p.unreadRune(); err != nil {
+					return "", err
+				}
+				break
+			}
+		} else if balanced && c == '[' {
+			depth++
+		} else if balanced && c == ']' && depth > 0 {
+			depth--
+		} else if !valid(c) || (kind == literalFieldName && c == p.fieldSep) || (kind == literalMessage && c == p.msgClose) {
+			if err := p.unreadRune(); err != nil {
+				return "", err
+			}
 			break
 		}
-		if !validLogLevelChar(c) {
-			return -1, fmt.Errorf("unexpected character '%c'", c)
+		if limit > 0 && n >= limit {
+			return "", fmt.Errorf("message too long, limit is %d", limit)
 		}
-		if n >= len(p.levelBuf) {
-			return -1, errors.New("log level too long")
+		if build {
+			literal = appendRune(literal, c)
 		}
-		p.levelBuf[n] = byte(c)
-		n++
 	}
-	return StringToLogLevel(string(p.levelBuf[:n]))
+	if intern {
+		p.internBuf = literal
+		if build {
+			return p.internBytes(literal), nil
+		}
+		return p.internString(p.lineStr[start:p.linePos()]), nil
+	}
+	p.literalBuf = literal
+	if !build {
+		return p.lineStr[start:p.linePos()], nil
+	}
+	return string(literal), nil
 }
 
-func (p *StreamParser) parseFileLine() (string, int, error) {
-	if err := p.skipChar('['); err != nil {
-		return "", 0, err
+// peekJSONValue reports whether the bare field value starting with '{' or
+// '[' is a JSON value, that is, its brackets are properly nested and closed
+// on the same line. Otherwise it is parsed as a bare literal like before, so
+// that a value like `{` still works. A value longer than the look-ahead is
+// assumed to be JSON.
+func (p *StreamParser) peekJSONValue() (bool, error) {
+	if p.lineLoaded {
+		return balancedJSONLen(p.lineBytes[p.linePos():]) > 0, nil
 	}
-	c, _, err := p.br.ReadRune()
+	line, err := p.peekLine()
 	if err != nil {
-		return "", 0, err
+		return false, err
 	}
-	if c == '<' {
-		// [<unknown>]
-		for {
-			c, _, err := p.br.ReadRune()
-			if err != nil {
-				return "", 0, err
-			}
-			if c == ']' {
-				break
-			}
-			if !((c >= 'a' && c <= 'z') || c == '<' || c == '>') {
-				return "", 0, fmt.Errorf("unexpected character '%c'", c)
+	n := balancedJSONLen(line)
+	return n > 0 || (n == 0 && len(line) == p.br.Size()), nil
+}
+
+// balancedJSONLen returns the length of the JSON value at the start of b,
+// up to the bracket closing the first one. It returns -1 if a bracket is
+// closed by the wrong kind, like in `[1,2}`, and 0 if b ends first.
+func balancedJSONLen(b []byte) int {
+	var stack [16]byte
+	closers := stack[:0]
+	quoted, escaped := false, false
+	// Multi-byte runes never contain the ASCII bytes checked here.
+	for i, c := range b {
+		switch {
+		case escaped:
+			escaped = false
+		case quoted:
+			escaped = c == '\\'
+			quoted = c != '"'
+		case c == '"':
+			quoted = true
+		case c == '{':
+			closers = append(closers, '}')
+		case c == '[':
+			closers = append(closers, ']')
+		case c == '}' || c == ']':
+			if closers[len(closers)-1] != c {
+				return -1
 			}
+			closers = closers[:len(closers)-1]
 		}
-		return "", 0, nil
-	} else {
-		if err := p.br.UnreadRune(); err != nil {
-			return "", 0, err
+		if len(closers) == 0 {
+			return i + 1
 		}
 	}
-	// [file:line]
-	var filename, line []rune
+	return 0
+}
+
+// parseJSONValue parses a bare field value starting with '{' or '[' as a
+// JSON object or array, up to the matching closing bracket, e.g. the values
+// of `[stats={"hit":1,"miss":[2]}]` and `[tags=[a,b,c]]`. Brackets in quoted
+// strings are ignored. The raw text is returned as is, it is not validated or
+// decoded, so a list of bare words is accepted as well.
+func (p *StreamParser) parseJSONValue() (string, error) {
+	start := p.linePos()
+	build := !p.lineLoaded
+	var value []byte
+	depth := 0
+	quoted, escaped := false, false
 	for {
-		c, _, err := p.br.ReadRune()
+		c, _, err := p.readRune()
 		if err != nil {
-			return "", 0, err
+			return "", err
 		}
-		if c == ':' {
-			break
+		if c == '\n' || c == '\r' {
+			return "", errors.New("unterminated JSON value")
 		}
-		if !validFilenameChar(c) {
-			return "", 0, fmt.Errorf("unexpected character '%c'", c)
+		if isControlChar(c) {
+			r, err := p.controlChar(c)
+			if err != nil {
+				return "", err
+			}
+			if !build {
+				build = true
+				value = append(value, p.lineStr[start:p.linePos()-1]...)
+			}
+			if r < 0 {
+				continue
+			}
+			c = r
 		}
-		filename = append(filename, c)
-	}
-	for {
-		c, _, err := p.br.ReadRune()
-		if err != nil {
-			return "", 0, err
+		if build {
+			value = appendRune(value, c)
 		}
-		if c == ']' {
-			break
+		switch {
+		case escaped:
+			escaped = false
+		case quoted:
+			escaped = c == '\\'
+			quoted = c != '"'
+		case c == '"':
+			quoted = true
+		case c == '{' || c == '[':
+			depth++
+		case c == '}' || c == ']':
+			depth--
 		}
-		if !validLineNumberChar(c) {
-			return "", 0, fmt.Errorf("unexpected character '%c'", c)
+		if depth == 0 {
+			break
 		}
-		line = append(line, c)
 	}
-	lineNum, err := strconv.Atoi(string(line))
-	if err != nil {
-		panic(err) // unreachable
+	if !build {
+		return p.lineStr[start:p.linePos()], nil
 	}
-	return string(filename), lineNum, nil
+	return string(value), nil
 }
 
-func (p *StreamParser) parseMessage() (string, error) {
-	if err := p.skipChar('['); err != nil {
-		return "", err
+// peekEscaped reports whether the next rune may be escaped by a backslash in
+// a bare literal of the given kind, and returns it. These are the field
+// separator and '=' in a field, and the brackets in a message or value if
+// bracket escaping is enabled.
+func (p *StreamParser) peekEscaped(kind literalKind) (rune, bool) {
+	b, _ := p.br.Peek(1)
+	if len(b) == 0 {
+		return 0, false
 	}
-	r, err := p.parseStringLiteral()
-	if err != nil {
-		return "", err
+	if b[0] >= utf8.RuneSelf {
+		// The separator or the message delimiters may be multi-byte.
+		b, _ = p.br.Peek(utf8.UTFMax)
 	}
-	if err := p.skipChar(']'); err != nil {
-		return "", err
+	c, _ := utf8.DecodeRune(b)
+	bracket := c == '[' || c == ']'
+	switch kind {
+	case literalMessage:
+		return c, p.bracketEscaping && (bracket || c == p.msgOpen || c == p.msgClose)
+	case literalFieldValue:
+		return c, (p.bracketEscaping && bracket) || c == p.fieldSep || c == '='
+	default:
+		return c, c == p.fieldSep || c == '='
 	}
-	return r, nil
 }
 
-func (p *StreamParser) parseFields() ([]LogField, error) {
-	var fields []LogField
-	for {
-		if err := p.trimChar(' '); err != nil {
-			if err == io.EOF {
-				return fields, nil
-			}
-			return nil, err
-		}
-		c, _, err := p.br.ReadRune()
-		if err != nil {
-			return nil, err
-		}
-		if c != '[' {
-			if err := p.br.UnreadRune(); err != nil {
-				return nil, err
-			}
-			return fields, nil
-		}
-		name, err := p.parseStringLiteral()
-		if err != nil {
-			return nil, err
-		}
-		if err := p.skipChar('='); err != nil {
-			return nil, err
-		}
-		value, err := p.parseStringLiteral()
-		if err != nil {
-			return nil, err
-		}
-		if err := p.skipChar(']'); err != nil {
-			return nil, err
-		}
-		fields = append(fields, LogField{
-			Name:  name,
-			Value: value,
-		})
+// maxInternedNames bounds the number of field names interned by a parser,
+// and maxInternedNameLen the length of an interned name in bytes.
+const (
+	maxInternedNames   = 4096
+	maxInternedNameLen = 128
+)
+
+// internBytes returns the interned string equal to b, see
+// WithStringInterning.
+func (p *StreamParser) internBytes(b []byte) string {
+	// The conversion in the map index does not allocate.
+	if s, ok := p.internTable[string(b)]; ok {
+		return s
 	}
+	s := string(b)
+	p.addInterned(s)
+	return s
 }
 
-// TODO: optimize
-func (p *StreamParser) parseStringLiteral() (string, error) {
-	c, _, err := p.br.ReadRune()
-	if err != nil {
-		return "", err
+// internString returns the interned string equal to s. A new string is
+// copied, so it does not retain the memory s is sliced from.
+func (p *StreamParser) internString(s string) string {
+	if interned, ok := p.internTable[s]; ok {
+		return interned
 	}
-	if err := p.br.UnreadRune(); err != nil {
-		return "", err
+	if len(s) <= maxInternedNameLen && len(p.internTable) < maxInternedNames {
+		s = string([]byte(s))
+		p.addInterned(s)
 	}
-	if c == '"' {
-		return p.parseStringJson()
+	return s
+}
+
+func (p *StreamParser) addInterned(s string) {
+	if len(s) > maxInternedNameLen || len(p.internTable) >= maxInternedNames {
+		return
 	}
-	var literal []rune
-	for {
-		c, _, err := p.br.ReadRune()
-		if err != nil {
-			return "", err
-		}
-		if !validStringLiteralChar(c) {
-			if err := p.br.UnreadRune(); err != nil {
-				return "", err
-			}
-			break
-		}
-		literal = append(literal, c)
+	if p.internTable == nil {
+		p.internTable = make(map[string]string)
 	}
-	return string(literal), nil
+	p.internTable[s] = s
 }
 
 // TODO: optimize
-func (p *StreamParser) parseStringJson() (string, error) {
+func (p *StreamParser) parseStringJson(kind literalKind) (string, error) {
+	limit := p.literalLimit(kind)
+	start := p.linePos()
+	// plain is true if the literal has nothing to decode, so it can be
+	// sliced from the line directly in line buffer mode.
+	plain := true
+	// The literal has to be built for decoding doubled quotes, even in line
+	// buffer mode, since the raw text is not valid JSON.
+	build := !p.lineLoaded || p.doubledQuoteEscaping
 	quotes := 0
+	n := 0
 	var literal []rune
+	startLine := p.line
 Loop:
 	for {
-		c, _, err := p.br.ReadRune()
+		c, _, err := p.readRune()
 		if err != nil {
-			return "", err
+			return "", unterminatedErr(err, startLine)
 		}
-		literal = append(literal, c)
-		switch c {
-		case '\\':
-			c, _, err := p.br.ReadRune()
+		if isControlChar(c) {
+			r, err := p.controlChar(c)
 			if err != nil {
 				return "", err
 			}
+			if !build {
+				build = true
+				literal = []rune(p.lineStr[start : p.linePos()-1])
+			}
+			plain = false
+			if r < 0 {
+				continue
+			}
+			c = r
+		}
+		// The raw literal also contains two quotes, which are not counted.
+		if limit > 0 && n >= limit+2 {
+			return "", fmt.Errorf("message too long, limit is %d", limit)
+		}
+		n++
+		if build {
 			literal = append(literal, c)
+		}
+		switch c {
+		case '\\':
+			c, _, err := p.readRune()
+			if err != nil {
+				return "", unterminatedErr(err, startLine)
+			}
+			n++
+			if build {
+				literal = append(literal, c)
+			}
+			plain = false
 		case '"':
 			quotes++
+			if quotes == 2 && p.doubledQuoteEscaping {
+				if b, _ := p.br.Peek(1); len(b) == 1 && b[0] == '"' {
+					// `""` is an escaped quote, rewrite it as `\"`.
+					if _, _, err := p.readRune(); err != nil {
+						return "", err
+					}
+					n++
+					literal[len(literal)-1] = '\\'
+					literal = append(literal, '"')
+					quotes = 1
+					plain = false
+					continue
+				}
+			}
 			if quotes == 2 {
 				break Loop
 			}
+		default:
+			if c < 0x20 || c == utf8.RuneError {
+				plain = false
+			}
 		}
 	}
+	if p.lineLoaded && plain {
+		raw := p.lineStr[start:p.linePos()]
+		return raw[1 : len(raw)-1], nil
+	}
 	var r string
+	if !build {
+		err := json.Unmarshal([]byte(p.lineStr[start:p.linePos()]), &r)
+		return r, err
+	}
 	err := json.Unmarshal([]byte(string(literal)), &r)
 	return r, err
 }
 
+// controlChar handles the control character c in a literal according to
+// the policy set by WithControlCharPolicy. It returns the rune to keep
+// instead, or -1 to drop it.
+func (p *StreamParser) controlChar(c rune) (rune, error) {
+	switch p.controlCharPolicy {
+	case ControlCharStrip:
+		if p.warnFunc != nil {
+			p.warn(fmt.Sprintf("control character %U is stripped", c))
+		}
+		return -1, nil
+	case ControlCharReplace:
+		if p.warnFunc != nil {
+			p.warn(fmt.Sprintf("control character %U is replaced", c))
+		}
+		return ' ', nil
+	default:
+		return 0, fmt.Errorf("unexpected control character %U", c)
+	}
+}
+
+// unterminatedErr describes an io.EOF hit inside of a quoted string, which
+// usually means the log was truncated.
+func unterminatedErr(err error, line int) error {
+	if err != io.EOF {
+		return err
+	}
+	return fmt.Errorf("unterminated quoted string starting at line %d: %w", line, io.ErrUnexpectedEOF)
+}
+
+// isUpper reports whether b has no lower case ASCII letters.
+func isUpper(b []byte) bool {
+	for _, c := range b {
+		if c >= 'a' && c <= 'z' {
+			return false
+		}
+	}
+	return true
+}
+
 func validDatetimeChar(c rune) bool {
 	return (c >= '0' && c <= '9') ||
 		c == '/' ||
@@ -480,11 +2283,12 @@ func validDatetimeChar(c rune) bool {
 		c == ':' ||
 		c == '.' ||
 		c == '+' ||
-		c == '-'
+		c == '-' ||
+		c == 'Z'
 }
 
 func validLogLevelChar(c rune) bool {
-	return c >= 'A' && c <= 'Z'
+	return (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z')
 }
 
 func validFilenameChar(c rune) bool {
@@ -493,13 +2297,32 @@ func validFilenameChar(c rune) bool {
 		(c >= '0' && c <= '9') ||
 		c == '.' ||
 		c == '-' ||
-		c == '_'
+		c == '_' ||
+		c == '/' ||
+		c == '\\'
+}
+
+// isControlChar reports whether c is a control character other than a line
+// break, see WithControlCharPolicy.
+func isControlChar(c rune) bool {
+	return c < 0x20 && c != '\n' && c != '\r'
 }
 
 func validLineNumberChar(c rune) bool {
 	return c >= '0' && c <= '9'
 }
 
+// appendRune appends the UTF-8 encoding of c to b, like utf8.AppendRune,
+// which needs Go 1.18.
+func appendRune(b []byte, c rune) []byte {
+	if c < utf8.RuneSelf {
+		return append(b, byte(c))
+	}
+	var buf [utf8.UTFMax]byte
+	n := utf8.EncodeRune(buf[:], c)
+	return append(b, buf[:n]...)
+}
+
 func validStringLiteralChar(c rune) bool {
 	return !((c >= 0x0000 && c <= 0x0020) || c == '"' || c == '=' || c == '[' || c == ']')
 }
@@ -1,9 +1,17 @@
 package logparser
 
 import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -29,9 +37,46 @@ func TestLogLevel(t *testing.T) {
 	level, err = StringToLogLevel("UNKNOWN")
 	assert.Error(t, err)
 	assert.Equal(t, LogLevelInfo, level)
+	for s, expect := range map[string]LogLevel{
+		"D": LogLevelDebug,
+		"I": LogLevelInfo,
+		"W": LogLevelWarn,
+		"E": LogLevelError,
+		"F": LogLevelFatal,
+		"i": LogLevelInfo,
+	} {
+		level, err = StringToLogLevel(s)
+		assert.NoError(t, err, s)
+		assert.Equal(t, expect, level, s)
+	}
+	_, err = StringToLogLevel("X")
+	assert.Error(t, err)
 	assert.Equal(t, "LEVEL(9999)", LogLevel(9999).String())
 }
 
+func TestLogLevel_Syslog(t *testing.T) {
+	for _, level := range []LogLevel{LogLevelDebug, LogLevelInfo, LogLevelWarn, LogLevelError, LogLevelFatal} {
+		l, err := LogLevelFromSyslog(level.Syslog())
+		assert.NoError(t, err)
+		assert.Equal(t, level, l)
+	}
+	assert.Equal(t, 2, LogLevelFatal.Syslog())
+	assert.Equal(t, 3, LogLevelError.Syslog())
+	assert.Equal(t, 4, LogLevelWarn.Syslog())
+	assert.Equal(t, 6, LogLevelInfo.Syslog())
+	assert.Equal(t, 7, LogLevelDebug.Syslog())
+	assert.Equal(t, -1, LogLevel(9999).Syslog())
+	for severity, expect := range []LogLevel{LogLevelFatal, LogLevelFatal, LogLevelFatal, LogLevelError, LogLevelWarn, LogLevelInfo, LogLevelInfo, LogLevelDebug} {
+		level, err := LogLevelFromSyslog(severity)
+		assert.NoError(t, err)
+		assert.Equal(t, expect, level)
+	}
+	_, err := LogLevelFromSyslog(8)
+	assert.Error(t, err)
+	_, err = LogLevelFromSyslog(-1)
+	assert.Error(t, err)
+}
+
 func TestStreamParser_skipChar(t *testing.T) {
 	parser := NewStreamParser(strings.NewReader("abc"))
 	err := parser.skipChar('a')
@@ -108,6 +153,26 @@ func TestStreamParser_parseDatetime(t *testing.T) {
 	assert.Equal(t, " [INFO]", s)
 }
 
+func TestStreamParser_parseDatetimeUTC(t *testing.T) {
+	for _, s := range []string{
+		"[2021/08/04 04:00:43.128 +00:00]",
+		"[2021/08/04 04:00:43.128 -00:00]",
+		"[2021/08/04 04:00:43.128 Z]",
+	} {
+		parser := NewStreamParser(strings.NewReader(s))
+		datetime, err := parser.parseDatetime()
+		assert.NoError(t, err, s)
+		assert.Equal(t, time.UTC, datetime.Location(), s)
+		assert.True(t, datetime.Equal(time.Date(2021, 8, 4, 4, 0, 43, 128*1000*1000, time.UTC)), s)
+	}
+	parser := NewStreamParser(strings.NewReader("[2021/08/04 12:00:43.128 +08:00]"))
+	datetime, err := parser.parseDatetime()
+	assert.NoError(t, err)
+	_, offset := datetime.Zone()
+	assert.Equal(t, 8*60*60, offset)
+	assert.True(t, datetime.Equal(time.Date(2021, 8, 4, 4, 0, 43, 128*1000*1000, time.UTC)))
+}
+
 func TestStreamParser_parseLogLevel(t *testing.T) {
 	parser := NewStreamParser(strings.NewReader("[INFO] [lib.rs:81]"))
 	level, err := parser.parseLogLevel()
@@ -118,6 +183,35 @@ func TestStreamParser_parseLogLevel(t *testing.T) {
 	assert.Equal(t, " [lib.rs:81]", s)
 }
 
+func TestStreamParser_parseLogLevelMixedCase(t *testing.T) {
+	parser := NewStreamParser(strings.NewReader("[Info][debug][WARN][eRRor]"))
+	for _, expect := range []LogLevel{LogLevelInfo, LogLevelDebug, LogLevelWarn, LogLevelError} {
+		level, err := parser.parseLogLevel()
+		assert.NoError(t, err)
+		assert.Equal(t, expect, level)
+	}
+}
+
+func TestStreamParser_parseLogLevelPadded(t *testing.T) {
+	parser := NewStreamParser(strings.NewReader("[ WARN ][INFO][  error][debug  ]"))
+	for _, expect := range []LogLevel{LogLevelWarn, LogLevelInfo, LogLevelError, LogLevelDebug} {
+		level, err := parser.parseLogLevel()
+		assert.NoError(t, err)
+		assert.Equal(t, expect, level)
+	}
+	for _, token := range []string{"[IN FO]", "[ INFO x]", "[ ]", "[ INFO"} {
+		parser := NewStreamParser(strings.NewReader(token))
+		_, err := parser.parseLogLevel()
+		assert.Error(t, err, token)
+	}
+	entries, err := ParseFromString(`[2021/08/04 12:00:43.128 +08:00] [ WARN ] [lib.rs:81] [msg]`, WithLineBuffer(true))
+	assert.NoError(t, err)
+	assert.Equal(t, LogLevelWarn, entries[0].Header.Level)
+	entries, err = ParseFromString(`[2021/08/04 12:00:43.128 +08:00] [E] [lib.rs:81] [msg]`)
+	assert.NoError(t, err)
+	assert.Equal(t, LogLevelError, entries[0].Header.Level)
+}
+
 func TestStreamParser_parseFileLine(t *testing.T) {
 	parser := NewStreamParser(strings.NewReader(`[lib.rs:81] ["Welcome to TiKV"]`))
 	file, line, err := parser.parseFileLine()
@@ -137,9 +231,48 @@ func TestStreamParser_parseFileLine(t *testing.T) {
 	assert.Equal(t, ` ["Welcome to TiKV"]`, s)
 }
 
+func TestStreamParser_parseFileLineOverflow(t *testing.T) {
+	parser := NewStreamParser(strings.NewReader(`[lib.rs:123456789012345678901234567890]`))
+	_, _, err := parser.parseFileLine()
+	assert.Error(t, err)
+	assert.True(t, errors.Is(err, strconv.ErrRange))
+	assert.Contains(t, err.Error(), "line number out of range")
+
+	_, err = ParseFromString(`[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:123456789012345678901234567890] [msg]`)
+	var perr *ParseError
+	assert.True(t, errors.As(err, &perr))
+	assert.Equal(t, StageFileLine, perr.Stage)
+	assert.True(t, errors.Is(err, strconv.ErrRange))
+}
+
+func TestStreamParser_parseFileLinePath(t *testing.T) {
+	for _, c := range []struct {
+		token string
+		file  string
+		line  int
+	}{
+		{`[/home/user/foo.rs:10]`, "/home/user/foo.rs", 10},
+		{`[src/engine/mod.rs:120]`, "src/engine/mod.rs", 120},
+		{`[src\engine\mod.rs:120]`, `src\engine\mod.rs`, 120},
+		{`[C:\src\engine\mod.rs:7]`, `C:\src\engine\mod.rs`, 7},
+		{`[C:/src/engine/mod.rs:7]`, `C:/src/engine/mod.rs`, 7},
+	} {
+		parser := NewStreamParser(strings.NewReader(c.token))
+		file, line, err := parser.parseFileLine()
+		assert.NoError(t, err, c.token)
+		assert.Equal(t, c.file, file, c.token)
+		assert.Equal(t, c.line, line, c.token)
+	}
+	for _, token := range []string{`[lib.rs]`, `[lib.rs:]`, `[C:\lib.rs]`, `[lib.rs:8x]`, `[lib rs:8]`} {
+		parser := NewStreamParser(strings.NewReader(token))
+		_, _, err := parser.parseFileLine()
+		assert.Error(t, err, token)
+	}
+}
+
 func TestStreamParser_parseStringJson(t *testing.T) {
 	parser := NewStreamParser(strings.NewReader(`"A \"hacker\"" (another)`))
-	s, err := parser.parseStringJson()
+	s, err := parser.parseStringJson(literalMessage)
 	assert.NoError(t, err)
 	assert.Equal(t, `A "hacker"`, s)
 	s, err = parser.br.ReadString('\n')
@@ -147,16 +280,30 @@ func TestStreamParser_parseStringJson(t *testing.T) {
 	assert.Equal(t, " (another)", s)
 }
 
+func TestStreamParser_parseStringJsonUnterminated(t *testing.T) {
+	for _, input := range []string{`"unterminated`, `"escape at the end\`} {
+		parser := NewStreamParser(strings.NewReader(input))
+		_, err := parser.parseStringJson(literalMessage)
+		assert.True(t, errors.Is(err, io.ErrUnexpectedEOF))
+		assert.Contains(t, err.Error(), "unterminated quoted string starting at line 1")
+	}
+	for _, opt := range []Option{WithLineBuffer(false), WithLineBuffer(true)} {
+		_, err := ParseFromString("\n[2021/09/23 14:25:14.123 +08:00] [INFO] [lib.rs:1] [\"unterminated", opt)
+		assert.True(t, errors.Is(err, io.ErrUnexpectedEOF))
+		assert.Contains(t, err.Error(), "unterminated quoted string starting at line 2")
+	}
+}
+
 func TestStreamParser_parseStringLiteral(t *testing.T) {
 	parser := NewStreamParser(strings.NewReader(`err="Grpc(RpcFailure(`))
-	s, err := parser.parseStringLiteral()
+	s, err := parser.parseStringLiteral(literalFieldName)
 	assert.NoError(t, err)
 	assert.Equal(t, "err", s)
 	s, err = parser.br.ReadString('\n')
 	assert.Equal(t, io.EOF, err)
 	assert.Equal(t, `="Grpc(RpcFailure(`, s)
 	parser = NewStreamParser(strings.NewReader(`"Grpc(RpcFailure(RpcStatus { code: 14-UNAVAILABLE, message: \"failed to connect to all addresses\", details: [] }))"] [endpoints=127.0.0.1:2379]`))
-	s, err = parser.parseStringLiteral()
+	s, err = parser.parseStringLiteral(literalFieldValue)
 	assert.NoError(t, err)
 	assert.Equal(t, `Grpc(RpcFailure(RpcStatus { code: 14-UNAVAILABLE, message: "failed to connect to all addresses", details: [] }))`, s)
 	s, err = parser.br.ReadString('\n')
@@ -164,6 +311,183 @@ func TestStreamParser_parseStringLiteral(t *testing.T) {
 	assert.Equal(t, "] [endpoints=127.0.0.1:2379]", s)
 }
 
+func TestStreamParser_parseStringLiteralEscapedSeparator(t *testing.T) {
+	log := `[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] [msg] [a\=b=c\=d] [x=y\z] [e=\=]`
+	for _, opts := range [][]Option{
+		{},
+		{WithLineBuffer(true)},
+		{WithStringInterning(true)},
+		{WithStringInterning(true), WithLineBuffer(true)},
+	} {
+		entries, err := ParseFromString(log, opts...)
+		assert.NoError(t, err)
+		assert.Equal(t, []LogField{{Name: "a=b", Value: "c=d"}, {Name: "x", Value: `y\z`}, {Name: "e", Value: "="}}, entries[0].Fields)
+	}
+	// Not in the message.
+	_, err := ParseFromString(`[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] [a\=b]`)
+	assert.Error(t, err)
+
+	entries, err := ParseFromString(`[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] [msg] [a\:b:c\=d]`, WithFieldSeparator(':'))
+	assert.NoError(t, err)
+	assert.Equal(t, []LogField{{Name: "a:b", Value: "c=d"}}, entries[0].Fields)
+}
+
+func TestStreamParser_parseJSONValue(t *testing.T) {
+	log := `[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] [msg] [stats={"hit":1,"miss":{"count":2,"keys":["a]","b\"}"]}}] [ids=[1,[2,3],[]]] [k={}]`
+	for _, opts := range [][]Option{{}, {WithLineBuffer(true)}} {
+		entries, err := ParseFromString(log, opts...)
+		assert.NoError(t, err)
+		assert.Len(t, entries, 1)
+		assert.Equal(t, []LogField{
+			{Name: "stats", Value: `{"hit":1,"miss":{"count":2,"keys":["a]","b\"}"]}}`},
+			{Name: "ids", Value: "[1,[2,3],[]]"},
+			{Name: "k", Value: "{}"},
+		}, entries[0].Fields)
+	}
+	for _, log := range []string{
+		`[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] [msg] [stats={"hit":1]`,
+		`[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] [msg] [stats={"hit":1}` + "\n",
+		`[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] [msg] [stats={"hit":1} x]`,
+		`[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] [msg] [k=[1,2}]`,
+	} {
+		_, err := ParseFromString(log)
+		assert.Error(t, err, log)
+	}
+
+	// A value which is not balanced before the end of the field is parsed
+	// as a bare literal.
+	log = `[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] [msg] [k={] [x=y] [v={a]`
+	for _, opts := range [][]Option{{}, {WithLineBuffer(true)}} {
+		entries, err := ParseFromString(log, opts...)
+		assert.NoError(t, err)
+		assert.Equal(t, []LogField{{Name: "k", Value: "{"}, {Name: "x", Value: "y"}, {Name: "v", Value: "{a"}}, entries[0].Fields)
+	}
+}
+
+// nestedValue returns a value like `{a:{a:{a:1}}}` nested depth times.
+func nestedValue(depth int, open, close string) string {
+	return strings.Repeat(open, depth) + "1" + strings.Repeat(close, depth)
+}
+
+func TestStreamParser_parseDeeplyNestedValues(t *testing.T) {
+	entry := "[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] [msg] "
+	for _, depth := range []int{1, 2, 63, 1000, 100000} {
+		for _, c := range []struct {
+			value string
+			opts  []Option
+		}{
+			{nestedValue(depth, "{a:", "}"), nil},
+			{nestedValue(depth, "[", "]"), nil},
+			{nestedValue(depth, `{"a":[`, "]}"), nil},
+			{"x" + nestedValue(depth, "[", "]"), []Option{WithBracketBalancedBareValues(true)}},
+		} {
+			log := entry + "[f=" + c.value + "] [g=" + c.value + "]\n"
+			for _, opts := range [][]Option{c.opts, append(c.opts[:len(c.opts):len(c.opts)], WithLineBuffer(true))} {
+				entries, err := ParseFromString(log+log, opts...)
+				if !assert.NoError(t, err, "depth=%d", depth) {
+					continue
+				}
+				assert.Len(t, entries, 2)
+				for _, e := range entries {
+					assert.Equal(t, []LogField{{Name: "f", Value: c.value}, {Name: "g", Value: c.value}}, e.Fields)
+				}
+			}
+			// Unbalanced values do not run on. They are rejected, or parsed
+			// as a bare literal up to the field's ']' if that is valid.
+			unbalanced := c.value[:len(c.value)-1]
+			entries, err := ParseFromString(entry+"[f="+unbalanced+"]\n"+log, c.opts...)
+			if err == nil {
+				assert.Equal(t, 2, len(entries), "depth=%d", depth)
+				assert.Equal(t, unbalanced, entries[0].Fields[0].Value, "depth=%d", depth)
+			}
+		}
+	}
+}
+
+func TestStreamParser_InvalidUTF8(t *testing.T) {
+	entry := "[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] "
+	for _, log := range []string{
+		entry + "[\"caf\xc3",
+		entry + "[caf\xc3",
+		entry + "[msg] [k=\"\xe4\xbd\"]",
+		entry + "[\xff]",
+	} {
+		for _, opts := range [][]Option{{}, {WithLineBuffer(true)}} {
+			_, err := ParseFromString(log, opts...)
+			assert.Error(t, err)
+			assert.Contains(t, err.Error(), "invalid or truncated UTF-8 at line 1", log)
+		}
+	}
+	entries, err := ParseFromString(entry + "[\"caf\xc3\xa9 \ufffd\"]")
+	assert.NoError(t, err)
+	assert.Equal(t, "caf\u00e9 \ufffd", entries[0].Message)
+}
+
+func TestStreamParser_parseFieldQuotedSeparator(t *testing.T) {
+	log := `[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] ["a=b"] [sql="SELECT a=b"] ["a=b"=value] ["k="="=v="] ["=="=""]`
+	for _, opts := range [][]Option{
+		{},
+		{WithLineBuffer(true)},
+		{WithStringInterning(true)},
+		{WithFlexibleTokenOrder(true)},
+	} {
+		entries, err := ParseFromString(log, opts...)
+		assert.NoError(t, err)
+		assert.Len(t, entries, 1)
+		assert.Equal(t, "a=b", entries[0].Message)
+		assert.Equal(t, []LogField{
+			{Name: "sql", Value: "SELECT a=b", ValueQuoted: true},
+			{Name: "a=b", Value: "value"},
+			{Name: "k=", Value: "=v=", ValueQuoted: true},
+			{Name: "==", Value: "", ValueQuoted: true},
+		}, entries[0].Fields)
+	}
+
+	entries, err := ParseFromString(`[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] [msg] ["a:b":"c:d"] [e:"f=g"]`, WithFieldSeparator(':'))
+	assert.NoError(t, err)
+	assert.Equal(t, []LogField{
+		{Name: "a:b", Value: "c:d", ValueQuoted: true},
+		{Name: "e", Value: "f=g", ValueQuoted: true},
+	}, entries[0].Fields)
+}
+
+func TestStreamParser_parseListValue(t *testing.T) {
+	log := `[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] [msg] [tags=[a,b,c]] [nested=[[a],[b,[c]],[]]] [empty=[]] [tags=[d]]`
+	for _, opts := range [][]Option{{}, {WithLineBuffer(true)}, {WithBracketBalancedBareValues(true)}} {
+		entries, err := ParseFromString(log, opts...)
+		assert.NoError(t, err)
+		assert.Len(t, entries, 1)
+		assert.Equal(t, []LogField{
+			{Name: "tags", Value: "[a,b,c]"},
+			{Name: "nested", Value: "[[a],[b,[c]],[]]"},
+			{Name: "empty", Value: "[]"},
+			{Name: "tags", Value: "[d]"},
+		}, entries[0].Fields)
+	}
+	for _, log := range []string{
+		`[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] [msg] [tags=[a,b]`,
+		`[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] [msg] [tags=[a,[b]]` + "\n",
+	} {
+		_, err := ParseFromString(log)
+		assert.Error(t, err, log)
+	}
+}
+
+func TestStreamParser_parseStringLiteralTrailingBackslash(t *testing.T) {
+	// Without WithBracketEscaping, a bare literal may end with a backslash.
+	log := `[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] [C:\temp\] [path=C:\Windows\] [x=y]`
+	for _, opts := range [][]Option{
+		{},
+		{WithLineBuffer(true)},
+		{WithBracketBalancedBareValues(true)},
+	} {
+		entries, err := ParseFromString(log, opts...)
+		assert.NoError(t, err)
+		assert.Equal(t, `C:\temp\`, entries[0].Message)
+		assert.Equal(t, []LogField{{Name: "path", Value: `C:\Windows\`}, {Name: "x", Value: "y"}}, entries[0].Fields)
+	}
+}
+
 func TestStreamParser_parseMessage(t *testing.T) {
 	parser := NewStreamParser(strings.NewReader(`[connecting]`))
 	msg, err := parser.parseMessage()
@@ -178,6 +502,21 @@ func TestStreamParser_parseMessage(t *testing.T) {
 	assert.Equal(t, " [xxx]", s)
 }
 
+func TestStreamParser_parseMessageEmpty(t *testing.T) {
+	for _, opts := range [][]Option{nil, {WithLineBuffer(true)}} {
+		entries, err := ParseFromString(`[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] [] [k=v]
+[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] [""] [k=v]
+[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] []`, opts...)
+		assert.NoError(t, err)
+		assert.Len(t, entries, 3)
+		for _, entry := range entries {
+			assert.Equal(t, "", entry.Message)
+		}
+		assert.True(t, entries[0].Equal(entries[1]))
+		assert.Len(t, entries[2].Fields, 0)
+	}
+}
+
 func TestStreamParser_parseFields(t *testing.T) {
 	parser := NewStreamParser(strings.NewReader("[err=\"Grpc(RpcFailure(RpcStatus { code: 14-UNAVAILABLE, message: \\\"failed to connect to all addresses\\\", details: [] }))\"] [endpoints=127.0.0.1:2379]\n"))
 	fields, err := parser.parseFields()
@@ -267,6 +606,266 @@ func TestStreamParser_ParseNext(t *testing.T) {
 `)
 }
 
+func TestStreamParser_parseDatetimeNoAlloc(t *testing.T) {
+	// A zone other than UTC allocates a time.Location, so "Z" is used.
+	log := "[2021/08/04 12:00:43.128 Z]"
+	for _, strict := range []bool{false, true} {
+		var r strings.Reader
+		parser := NewStreamParser(&r, WithStrictDatetime(strict))
+		allocs := testing.AllocsPerRun(100, func() {
+			r.Reset(log)
+			parser.Reset(&r)
+			_, err := parser.parseDatetime()
+			assert.NoError(t, err)
+		})
+		assert.Equal(t, float64(0), allocs, "strict=%v", strict)
+	}
+}
+
+func TestStreamParser_ParseNextEOFNoAlloc(t *testing.T) {
+	var r strings.Reader
+	parser := NewStreamParser(&r)
+	for _, log := range []string{"", "\n\r\n\n"} {
+		allocs := testing.AllocsPerRun(100, func() {
+			r.Reset(log)
+			parser.Reset(&r)
+			entry, err := parser.ParseNext()
+			assert.Nil(t, entry)
+			assert.NoError(t, err)
+		})
+		assert.Equal(t, float64(0), allocs, "%q", log)
+	}
+}
+
+func TestStreamParser_ParseInto(t *testing.T) {
+	log := `[2021/08/04 12:00:43.129 +08:00] [DEBUG] [<unknown>] [test_message] [test_k1=test_v1] ["test k2"="test v2"]
+[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] ["Welcome to TiKV"] [k=v]
+[2021/08/04 12:00:43.129 +08:00] [WARN] [lib.rs:86] [done]`
+	expect, err := ParseFromString(log)
+	assert.NoError(t, err)
+	parser := NewStreamParser(strings.NewReader(log))
+	var entry LogEntry
+	for i, e := range expect {
+		ok, err := parser.ParseInto(&entry)
+		assert.NoError(t, err)
+		assert.True(t, ok)
+		assert.Equal(t, e.Header, entry.Header, i)
+		assert.Equal(t, e.Message, entry.Message, i)
+		assert.Equal(t, len(e.Fields), len(entry.Fields), i)
+		assert.True(t, e.Equal(&entry), i)
+	}
+	// The Fields slice is reused.
+	assert.Equal(t, 2, cap(entry.Fields))
+	ok, err := parser.ParseInto(&entry)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+}
+
+func TestStreamParser_ParseNextBOM(t *testing.T) {
+	log := "\ufeff[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] [\"Welcome to TiKV\"]\n"
+	for _, opt := range []Option{WithLineBuffer(false), WithLineBuffer(true)} {
+		entries, err := ParseFromString(log+log[3:], opt)
+		assert.NoError(t, err)
+		assert.Len(t, entries, 2)
+		assert.Equal(t, "Welcome to TiKV", entries[0].Message)
+	}
+	// Only a leading BOM is skipped.
+	_, err := ParseFromString(log + log)
+	assert.Error(t, err)
+	entries, err := ParseFromString("\ufeff")
+	assert.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestStreamParser_ParseNextQuoted(t *testing.T) {
+	log := `[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] [connecting] [a=b] [c="d"]
+[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] ["connecting to PD"] ["e f"=g]`
+	for _, opt := range []Option{WithLineBuffer(false), WithLineBuffer(true)} {
+		entries, err := ParseFromString(log, opt)
+		assert.NoError(t, err)
+		assert.False(t, entries[0].MessageQuoted)
+		assert.Equal(t, []LogField{{Name: "a", Value: "b"}, {Name: "c", Value: "d", ValueQuoted: true}}, entries[0].Fields)
+		assert.True(t, entries[1].MessageQuoted)
+		assert.Equal(t, []LogField{{Name: "e f", Value: "g"}}, entries[1].Fields)
+	}
+	entries, err := ParseFromString(`[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] "not quoted" [k=v]`, WithUnbracketedMessage(true))
+	assert.NoError(t, err)
+	assert.False(t, entries[0].MessageQuoted)
+	assert.Equal(t, `"not quoted"`, entries[0].Message)
+}
+
+func TestStreamParser_LevelCount(t *testing.T) {
+	log := `[2021/08/04 12:00:43.128 +08:00] [DEBUG] [lib.rs:81] [msg]
+[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] [msg]
+[2021/08/04 12:00:43.128 +08:00] [DEBUG] [lib.rs:81] [msg]
+[2021/08/04 12:00:43.128 +08:00] [FATAL] [lib.rs:81] [msg]
+[2021/08/04 12:00:43.128 +08:00] [ERROR] [lib.rs:81] [msg`
+	parser := NewStreamParser(strings.NewReader(log))
+	for i := 0; i < 2; i++ {
+		_, err := parser.ParseNext()
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, 1, parser.LevelCount(LogLevelDebug))
+	assert.Equal(t, 1, parser.LevelCount(LogLevelInfo))
+	for i := 0; i < 2; i++ {
+		_, err := parser.ParseNext()
+		assert.NoError(t, err)
+	}
+	_, err := parser.ParseNext()
+	assert.Error(t, err)
+	for level, expect := range map[LogLevel]int{
+		LogLevelDebug: 2,
+		LogLevelInfo:  1,
+		LogLevelWarn:  0,
+		LogLevelError: 0, // Incomplete
+		LogLevelFatal: 1,
+		LogLevel(-2):  0,
+		LogLevel(4):   0,
+	} {
+		assert.Equal(t, expect, parser.LevelCount(level), level)
+	}
+	parser.Reset(strings.NewReader(""))
+	assert.Equal(t, 0, parser.LevelCount(LogLevelDebug))
+}
+
+func TestStreamParser_Progress(t *testing.T) {
+	line := "[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] [msg]\n"
+	log := strings.Repeat(line, 100)
+	for _, opt := range []Option{WithLineBuffer(false), WithLineBuffer(true)} {
+		parser := NewStreamParser(strings.NewReader(log), opt)
+		bytesRead, entries := parser.Progress()
+		assert.Equal(t, int64(0), bytesRead)
+		assert.Equal(t, 0, entries)
+		_, err := parser.ParseNext()
+		assert.NoError(t, err)
+		bytesRead, entries = parser.Progress()
+		assert.Equal(t, int64(len(line)-1), bytesRead)
+		assert.Equal(t, 1, entries)
+		_, err = parser.ParseBatch(1000)
+		assert.NoError(t, err)
+		bytesRead, entries = parser.Progress()
+		assert.Equal(t, int64(len(log)), bytesRead)
+		assert.Equal(t, 100, entries)
+
+		parser.Reset(strings.NewReader(line))
+		bytesRead, entries = parser.Progress()
+		assert.Equal(t, int64(0), bytesRead)
+		assert.Equal(t, 0, entries)
+	}
+}
+
+func TestStreamParser_Line(t *testing.T) {
+	parser := NewStreamParser(strings.NewReader(`
+[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] [1]
+
+[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:x] [2]`))
+	assert.Equal(t, 1, parser.Line())
+	_, err := parser.ParseNext()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, parser.Line())
+	_, err = parser.ParseNext()
+	var perr *ParseError
+	assert.True(t, errors.As(err, &perr))
+	assert.Equal(t, 4, parser.Line())
+	assert.Equal(t, perr.Line, parser.Line())
+}
+
+func TestStreamParser_LineEnding(t *testing.T) {
+	entry := `[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] [msg]`
+	for _, opt := range []Option{WithLineBuffer(false), WithLineBuffer(true)} {
+		parser := NewStreamParser(strings.NewReader(entry), opt)
+		_, err := parser.ParseNext()
+		assert.NoError(t, err)
+		assert.Equal(t, "", parser.LineEnding())
+
+		parser.Reset(strings.NewReader(entry + "\n" + entry + "\n"))
+		_, err = parser.ParseBatch(10)
+		assert.NoError(t, err)
+		assert.Equal(t, "\n", parser.LineEnding())
+		assert.False(t, parser.MixedLineEndings())
+
+		parser.Reset(strings.NewReader(entry + "\r\n\r\n" + entry + "\r\n"))
+		_, err = parser.ParseBatch(10)
+		assert.NoError(t, err)
+		assert.Equal(t, "\r\n", parser.LineEnding())
+		assert.False(t, parser.MixedLineEndings())
+
+		parser.Reset(strings.NewReader(entry + "\r\n" + entry + "\n"))
+		_, err = parser.ParseBatch(10)
+		assert.NoError(t, err)
+		assert.Equal(t, "\r\n", parser.LineEnding())
+		assert.True(t, parser.MixedLineEndings())
+
+		parser.Reset(strings.NewReader(""))
+		assert.Equal(t, "", parser.LineEnding())
+		assert.False(t, parser.MixedLineEndings())
+	}
+
+	parser := NewStreamParser(strings.NewReader(entry+"\n  at main.go:12\r\n"), WithAttachContinuations(true))
+	_, err := parser.ParseBatch(10)
+	assert.NoError(t, err)
+	assert.Equal(t, "\n", parser.LineEnding())
+	assert.True(t, parser.MixedLineEndings())
+}
+
+func TestStreamParser_ParseBatch(t *testing.T) {
+	parser := NewStreamParser(strings.NewReader(`[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] [1]
+[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] [2]
+[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] [3]
+[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] [4]
+[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] [5]
+`))
+	for _, n := range []int{0, -1} {
+		batch, err := parser.ParseBatch(n)
+		assert.NoError(t, err)
+		assert.NotNil(t, batch)
+		assert.Len(t, batch, 0)
+	}
+	batch, err := parser.ParseBatch(2)
+	assert.NoError(t, err)
+	assert.Len(t, batch, 2)
+	assert.Equal(t, "1", batch[0].Message)
+	assert.Equal(t, "2", batch[1].Message)
+	batch, err = parser.ParseBatch(2)
+	assert.NoError(t, err)
+	assert.Len(t, batch, 2)
+	assert.Equal(t, "3", batch[0].Message)
+	batch, err = parser.ParseBatch(2)
+	assert.NoError(t, err)
+	assert.Len(t, batch, 1)
+	assert.Equal(t, "5", batch[0].Message)
+	batch, err = parser.ParseBatch(2)
+	assert.NoError(t, err)
+	assert.Len(t, batch, 0)
+
+	parser = NewStreamParser(strings.NewReader(`[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] [1]
+[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:x] [2]`))
+	batch, err = parser.ParseBatch(3)
+	assert.Error(t, err)
+	assert.Len(t, batch, 1)
+	assert.Equal(t, "1", batch[0].Message)
+}
+
+func TestStreamParser_SkipLines(t *testing.T) {
+	parser := NewStreamParser(strings.NewReader("Banner\r\n  of the log " + strings.Repeat("-", 10000) + "\n\n[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:x] [1]\nlast"))
+	assert.NoError(t, parser.SkipLines(2))
+	assert.Equal(t, 3, parser.line)
+	assert.NoError(t, parser.SkipLines(0))
+	entry, err := parser.ParseNext()
+	assert.Nil(t, entry)
+	var perr *ParseError
+	assert.True(t, errors.As(err, &perr))
+	assert.Equal(t, 4, perr.Line)
+	assert.NoError(t, parser.SkipLines(1))
+	assert.Equal(t, 5, parser.line)
+	assert.NoError(t, parser.SkipLines(1))
+	assert.Equal(t, io.EOF, parser.SkipLines(1))
+
+	parser = NewStreamParser(strings.NewReader("1\n2\n"))
+	assert.Equal(t, io.EOF, parser.SkipLines(3))
+	assert.Equal(t, 3, parser.line)
+}
+
 func TestParseFromString(t *testing.T) {
 	entries, err := ParseFromString(`[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] ["Welcome to TiKV"]
 [2021/08/04 12:00:43.129 +08:00] [INFO] [lib.rs:86] ["Release Version:   5.1.0-alpha"]`)
@@ -280,3 +879,209 @@ func TestParseFromBytes(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Len(t, entries, 2)
 }
+
+func TestParseFromReaderSized(t *testing.T) {
+	log := `[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] [1]
+[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] [2]`
+	expect, err := ParseFromString(log)
+	assert.NoError(t, err)
+	for _, hint := range []int{-1, 0, 1, 2, 100} {
+		entries, err := ParseFromReaderSized(strings.NewReader(log), hint)
+		assert.NoError(t, err)
+		assert.Equal(t, expect, entries)
+	}
+	entries, err := ParseFromReaderSized(strings.NewReader(log), 100)
+	assert.NoError(t, err)
+	assert.Equal(t, 100, cap(entries))
+	_, err = ParseFromReaderSized(strings.NewReader(log+"\nx"), 100)
+	assert.Error(t, err)
+}
+
+func TestParseFromReaderN(t *testing.T) {
+	log := `[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] [1]
+[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] [2]
+[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] [3]
+[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:x] [4]`
+	entries, err := ParseFromStringN(log, 2)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 2)
+	assert.Equal(t, "2", entries[1].Message)
+	entries, err = ParseFromReaderN(strings.NewReader(log), 3)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 3)
+	entries, err = ParseFromStringN(log, 0)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 0)
+	_, err = ParseFromStringN(log, 4)
+	assert.Error(t, err)
+	entries, err = ParseFromStringN(log[:strings.LastIndexByte(log, '\n')], 10)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 3)
+}
+
+func TestParseTail(t *testing.T) {
+	var b strings.Builder
+	for i := 0; i < 10; i++ {
+		fmt.Fprintf(&b, "[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] [msg%d] [i=%d]\n", i, i)
+		if i%3 == 0 {
+			fmt.Fprintf(&b, "[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] [msg%d]\n", i)
+		}
+	}
+	all, err := ParseFromString(b.String())
+	assert.NoError(t, err)
+	for _, n := range []int{1, 3, 5, len(all), len(all) + 3} {
+		entries, err := ParseTail(strings.NewReader(b.String()), n)
+		assert.NoError(t, err)
+		expect := all
+		if n < len(all) {
+			expect = all[len(all)-n:]
+		}
+		assert.Equal(t, expect, entries, n)
+	}
+	entries, err := ParseTail(strings.NewReader(b.String()), 0)
+	assert.NoError(t, err)
+	assert.Empty(t, entries)
+	_, err = ParseTail(strings.NewReader(b.String()+"bad"), 3)
+	assert.Error(t, err)
+	_, err = ParseTail(strings.NewReader(b.String()+"bad"), 0)
+	assert.Error(t, err)
+}
+
+func TestParseTimeWindow(t *testing.T) {
+	log := `[2021/08/04 12:00:41.000 +08:00] [INFO] [lib.rs:81] [1]
+[2021/08/04 12:00:42.000 +08:00] [INFO] [lib.rs:81] [2]
+[2021/08/04 12:00:43.000 +08:00] [INFO] [lib.rs:81] [3]
+[2021/08/04 12:00:44.000 +08:00] [INFO] [lib.rs:81] [4]
+[2021/08/04 12:00:45.000 +08:00] [INFO] [lib.rs:x] [5]`
+	zone := time.FixedZone("", 8*60*60)
+	from := time.Date(2021, 8, 4, 12, 0, 42, 0, zone)
+	to := time.Date(2021, 8, 4, 12, 0, 44, 0, zone)
+
+	// The malformed entry after the window is never parsed.
+	entries, err := ParseTimeWindow(strings.NewReader(log), from, to, WithAssumeSorted(true))
+	assert.NoError(t, err)
+	assert.Len(t, entries, 2)
+	assert.Equal(t, "2", entries[0].Message)
+	assert.Equal(t, "3", entries[1].Message)
+	_, err = ParseTimeWindow(strings.NewReader(log), from, to)
+	assert.Error(t, err)
+
+	unsorted := `[2021/08/04 12:00:44.000 +08:00] [INFO] [lib.rs:81] [4]
+[2021/08/04 12:00:42.000 +08:00] [INFO] [lib.rs:81] [2]
+[2021/08/04 12:00:41.000 +08:00] [INFO] [lib.rs:81] [1]
+[2021/08/04 12:00:43.500 +08:00] [INFO] [lib.rs:81] [3]`
+	entries, err = ParseTimeWindow(strings.NewReader(unsorted), from, to)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 2)
+	assert.Equal(t, "2", entries[0].Message)
+	assert.Equal(t, "3", entries[1].Message)
+	entries, err = ParseTimeWindow(strings.NewReader(unsorted), from, to, WithAssumeSorted(true))
+	assert.NoError(t, err)
+	assert.Len(t, entries, 0)
+}
+
+func TestParseDedup(t *testing.T) {
+	a := "[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] [msg] [k=v]\n"
+	b := "[2021/08/04 12:00:43.129 +08:00] [INFO] [lib.rs:81] [msg] [k=v]\n"
+	entries, err := ParseDedup(strings.NewReader(a + a + b))
+	assert.NoError(t, err)
+	assert.Len(t, entries, 2)
+	assert.Equal(t, "2021/08/04 12:00:43.129 +08:00", entries[1].Header.DateTime.Format(datetimeLayout))
+
+	// Only consecutive duplicates are dropped.
+	entries, err = ParseDedup(strings.NewReader(a + b + a + a + a))
+	assert.NoError(t, err)
+	assert.Len(t, entries, 3)
+
+	_, err = ParseDedup(strings.NewReader(a + "bad"))
+	assert.Error(t, err)
+}
+
+func TestParseFromReaders(t *testing.T) {
+	entries, err := ParseFromReaders([]io.Reader{
+		strings.NewReader("[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] [1]\n[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] [2]"),
+		strings.NewReader(""),
+		strings.NewReader("\n[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] [3]\n"),
+	})
+	assert.NoError(t, err)
+	assert.Len(t, entries, 3)
+	assert.Equal(t, "3", entries[2].Message)
+
+	// An entry must not span two readers.
+	_, err = ParseFromReaders([]io.Reader{
+		strings.NewReader("[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] [1]\n"),
+		strings.NewReader("\n[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] [2]\n[2021/08/04 12:00:43.128 +08:00] [INFO]"),
+		strings.NewReader(" [lib.rs:81] [3]\n"),
+	})
+	assert.Error(t, err)
+	assert.True(t, strings.HasPrefix(err.Error(), "reader 1: "))
+	var perr *ParseError
+	assert.True(t, errors.As(err, &perr))
+	assert.Equal(t, 3, perr.Line)
+
+	entries, err = ParseFromReaders(nil)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 0)
+
+	// Options apply to every reader.
+	entries, err = ParseFromReaders([]io.Reader{
+		strings.NewReader("[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] {1} [k:v]\n"),
+		strings.NewReader("[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] {2}\n"),
+	}, WithMessageDelimiters('{', '}'), WithFieldSeparator(':'))
+	assert.NoError(t, err)
+	assert.Len(t, entries, 2)
+	assert.Equal(t, "2", entries[1].Message)
+	assert.Equal(t, []LogField{{Name: "k", Value: "v"}}, entries[0].Fields)
+}
+
+func TestValidate(t *testing.T) {
+	log := `[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] ["Welcome to TiKV"]
+[2021/08/04 12:00:43.129 +08:00] [DEBUG] [<unknown>] [test_message] [test_k1=test_v1] ["test k2"="test v2"]
+`
+	assert.NoError(t, Validate(strings.NewReader(log)))
+	assert.NoError(t, Validate(strings.NewReader("")))
+	err := Validate(strings.NewReader(log + "[2021/08/04 12:00:43.129 +08:00] [BAD] [lib.rs:1] [msg]\n"))
+	var perr *ParseError
+	assert.True(t, errors.As(err, &perr))
+	assert.Equal(t, 3, perr.Line)
+	assert.Equal(t, StageLevel, perr.Stage)
+	assert.Error(t, Validate(strings.NewReader(log+"[2021/08/04 12:00:43.129 +08:00] [INFO] [lib.rs:1] [msg] x"), WithLineBuffer(true)))
+}
+
+func TestParseFromFile(t *testing.T) {
+	log := `[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] ["Welcome to TiKV"]
+[2021/08/04 12:00:43.129 +08:00] [INFO] [lib.rs:86] ["Release Version:   5.1.0-alpha"]`
+	dir := t.TempDir()
+	plain := filepath.Join(dir, "tikv.log")
+	assert.NoError(t, ioutil.WriteFile(plain, []byte(log), 0644))
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	_, err := w.Write([]byte(log))
+	assert.NoError(t, err)
+	assert.NoError(t, w.Close())
+	// The gzip file is detected by content, not by extension.
+	compressed := filepath.Join(dir, "tikv.log.1")
+	assert.NoError(t, ioutil.WriteFile(compressed, buf.Bytes(), 0644))
+	for _, path := range []string{plain, compressed} {
+		entries, err := ParseFromFile(path)
+		assert.NoError(t, err)
+		assert.Len(t, entries, 2)
+		assert.Equal(t, "Release Version:   5.1.0-alpha", entries[1].Message)
+	}
+	_, err = ParseFromFile(filepath.Join(dir, "not_exist.log"))
+	assert.Error(t, err)
+}
+
+func TestStreamParser_DebugString(t *testing.T) {
+	parser := NewStreamParser(strings.NewReader(`[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] ["Welcome to TiKV"]
+[2021/08/04 12:00:43.129 +08:00] [WARN] [lib.rs:8x] ["Release Version:   5.1.0-alpha"]`))
+	assert.Equal(t, `line=1 column=0 stage="" upcoming="[2021/08/04 12:00:43.128 +08:00]" datetime="" level=""`, parser.DebugString())
+	_, err := parser.ParseNext()
+	assert.NoError(t, err)
+	assert.Equal(t, `line=1 column=71 stage="field" upcoming="\n[2021/08/04 12:00:43.129 +08:00" datetime="2021/08/04 12:00:43.128 +08:00" level="INFO"`, parser.DebugString())
+	// DebugString does not advance the reader.
+	assert.Equal(t, parser.DebugString(), parser.DebugString())
+	_, err = parser.ParseNext()
+	assert.Error(t, err)
+	assert.Equal(t, `line=2 column=51 stage="level" upcoming=" [\"Release Version:   5.1.0-alph" datetime="2021/08/04 12:00:43.129 +08:00" level="WARN"`, parser.DebugString())
+}
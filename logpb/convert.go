@@ -0,0 +1,92 @@
+// Package logpb provides the protobuf messages of log entries, generated from
+// log.proto, and the conversion from and to logparser.LogEntry. It is kept
+// apart from package logparser, so the parser does not depend on protobuf.
+package logpb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative log.proto
+
+import (
+	"time"
+
+	logparser "github.com/mornyx/landing-log-parser"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// ToProto converts e to its protobuf message. Whether the message and the
+// values were quoted, the original offset and the partial flag are not
+// kept. It returns nil if e is nil.
+func ToProto(e *logparser.LogEntry) *LogEntry {
+	if e == nil {
+		return nil
+	}
+	_, offset := e.Header.DateTime.Zone()
+	m := &LogEntry{
+		Time:         timestamppb.New(e.Header.DateTime),
+		UtcOffset:    int32(offset),
+		Level:        levelToProto(e.Header.Level),
+		File:         e.Header.File,
+		Line:         int64(e.Header.Line),
+		Message:      e.Message,
+		Continuation: e.Continuation,
+		Comment:      e.Comment,
+		Source:       e.Source,
+		Trailer:      e.Trailer,
+	}
+	if len(e.Fields) > 0 {
+		m.Fields = make([]*LogField, len(e.Fields))
+		for i, f := range e.Fields {
+			m.Fields[i] = &LogField{Name: f.Name, Value: f.Value}
+		}
+	}
+	return m
+}
+
+// FromProto converts m back to a log entry. The timestamp is in a fixed zone
+// with the offset of m, or UTC if the offset is zero, as parsed from a log.
+// An unspecified or unknown level is converted to logparser.LogLevelInfo. It
+// returns nil if m is nil.
+func FromProto(m *LogEntry) *logparser.LogEntry {
+	if m == nil {
+		return nil
+	}
+	e := &logparser.LogEntry{
+		Header: logparser.LogHeader{
+			Level: levelFromProto(m.Level),
+			File:  m.File,
+			Line:  int(m.Line),
+		},
+		Message:      m.Message,
+		Continuation: m.Continuation,
+		Comment:      m.Comment,
+		Source:       m.Source,
+		Trailer:      m.Trailer,
+	}
+	if m.Time != nil {
+		loc := time.UTC
+		if m.UtcOffset != 0 {
+			loc = time.FixedZone("", int(m.UtcOffset))
+		}
+		e.Header.DateTime = m.Time.AsTime().In(loc)
+	}
+	if len(m.Fields) > 0 {
+		e.Fields = make([]logparser.LogField, len(m.Fields))
+		for i, f := range m.Fields {
+			e.Fields[i] = logparser.LogField{Name: f.GetName(), Value: f.GetValue()}
+		}
+	}
+	return e
+}
+
+func levelToProto(l logparser.LogLevel) LogLevel {
+	if l < logparser.LogLevelDebug || l > logparser.LogLevelFatal {
+		return LogLevel_LOG_LEVEL_UNSPECIFIED
+	}
+	return LogLevel_LOG_LEVEL_DEBUG + LogLevel(l-logparser.LogLevelDebug)
+}
+
+func levelFromProto(l LogLevel) logparser.LogLevel {
+	if l < LogLevel_LOG_LEVEL_DEBUG || l > LogLevel_LOG_LEVEL_FATAL {
+		return logparser.LogLevelInfo
+	}
+	return logparser.LogLevelDebug + logparser.LogLevel(l-LogLevel_LOG_LEVEL_DEBUG)
+}
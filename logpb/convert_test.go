@@ -0,0 +1,52 @@
+package logpb
+
+import (
+	"testing"
+	"time"
+
+	logparser "github.com/mornyx/landing-log-parser"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestProtoRoundTrip(t *testing.T) {
+	entries, err := logparser.ParseFromString(`[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] ["Welcome"] [region_id=4] ["test k2"="test v2"]
+[2021/08/04 12:00:44.000 Z] [DEBUG] [<unknown>] [msg]
+[2021/08/04 12:00:45.000 -05:00] [FATAL] [main.go:1] [panic]
+  backtrace`, logparser.WithAttachContinuations(true))
+	assert.NoError(t, err)
+	for _, e := range entries {
+		b, err := proto.Marshal(ToProto(e))
+		assert.NoError(t, err)
+		var m LogEntry
+		assert.NoError(t, proto.Unmarshal(b, &m))
+		got := FromProto(&m)
+		assert.True(t, e.Equal(got), "%v != %v", e, got)
+		_, expect := e.Header.DateTime.Zone()
+		_, offset := got.Header.DateTime.Zone()
+		assert.Equal(t, expect, offset)
+		assert.Equal(t, e.String(), got.String())
+	}
+
+	m := ToProto(entries[0])
+	assert.Equal(t, LogLevel_LOG_LEVEL_INFO, m.Level)
+	assert.Equal(t, int32(8*3600), m.UtcOffset)
+	assert.Equal(t, time.Date(2021, 8, 4, 4, 0, 43, 128000000, time.UTC), m.Time.AsTime())
+	assert.Equal(t, "region_id", m.Fields[0].Name)
+	assert.Equal(t, LogLevel_LOG_LEVEL_DEBUG, ToProto(entries[1]).Level)
+	assert.Equal(t, LogLevel_LOG_LEVEL_FATAL, ToProto(entries[2]).Level)
+
+	// The trailer is kept.
+	entries, err = logparser.ParseFromString(`[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] [msg] [k=v] extra text`,
+		logparser.WithTrailingTokenPolicy(logparser.TrailingTokenCapture))
+	assert.NoError(t, err)
+	m = ToProto(entries[0])
+	assert.Equal(t, "extra text", m.Trailer)
+	assert.Equal(t, "extra text", FromProto(m).Trailer)
+
+	assert.Nil(t, ToProto(nil))
+	assert.Nil(t, FromProto(nil))
+	e := FromProto(&LogEntry{Level: LogLevel(42)})
+	assert.Equal(t, logparser.LogLevelInfo, e.Header.Level)
+	assert.True(t, e.Header.DateTime.IsZero())
+}
@@ -0,0 +1,102 @@
+package logparser
+
+import (
+	"io"
+	"sort"
+	"time"
+)
+
+// NormalizeOption configures a reader created by NewNormalizingReader.
+type NormalizeOption func(*normalizingReader)
+
+// WithParserOptions sets the options of the StreamParser which parses the
+// source log of a normalizing reader.
+func WithParserOptions(opts ...Option) NormalizeOption {
+	return func(r *normalizingReader) {
+		r.parserOpts = opts
+	}
+}
+
+// WithOutputLocation sets the location the timestamps are converted to by a
+// normalizing reader. The default is UTC. A nil loc keeps the zone of each
+// timestamp.
+func WithOutputLocation(loc *time.Location) NormalizeOption {
+	return func(r *normalizingReader) {
+		r.loc = loc
+	}
+}
+
+// WithSortedFields sets whether a normalizing reader sorts the fields of
+// each entry by name, which it does by default. The sort is stable, so
+// fields with the same name keep their order.
+func WithSortedFields(enable bool) NormalizeOption {
+	return func(r *normalizingReader) {
+		r.sortFields = enable
+	}
+}
+
+// normalizingReader is the io.Reader returned by NewNormalizingReader.
+type normalizingReader struct {
+	p          *StreamParser
+	parserOpts []Option
+	loc        *time.Location
+	sortFields bool
+	entry      LogEntry
+	// buf is the rest of the current normalized entry.
+	buf []byte
+	err error
+}
+
+// NewNormalizingReader returns an io.Reader which yields a normalized version
+// of the log read from src: each entry is parsed, and written back as by
+// LogEntry.String, with timestamps in UTC and fields sorted by name by
+// default, and a line break after each entry. The source is parsed on
+// demand, one entry at a time, so it is never buffered as a whole. A parse
+// error is returned by Read, after all prior entries have been read.
+func NewNormalizingReader(src io.Reader, opts ...NormalizeOption) io.Reader {
+	r := &normalizingReader{
+		loc:        time.UTC,
+		sortFields: true,
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	r.p = NewStreamParser(src, r.parserOpts...)
+	return r
+}
+
+func (r *normalizingReader) Read(b []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		r.next()
+	}
+	n := copy(b, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// next parses and normalizes the next entry into buf, or sets err.
+func (r *normalizingReader) next() {
+	ok, err := r.p.ParseInto(&r.entry)
+	if err != nil {
+		r.err = err
+		return
+	}
+	if !ok {
+		r.err = io.EOF
+		return
+	}
+	e := &r.entry
+	if r.loc != nil {
+		e.Header.DateTime = e.Header.DateTime.In(r.loc)
+	}
+	if r.sortFields {
+		sort.SliceStable(e.Fields, func(i, j int) bool {
+			return e.Fields[i].Name < e.Fields[j].Name
+		})
+	}
+	r.buf = append(r.buf[:0], e.String()...)
+	r.buf = append(r.buf, '\n')
+}
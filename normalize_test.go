@@ -0,0 +1,68 @@
+package logparser
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewNormalizingReader(t *testing.T) {
+	log := `[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] ["Welcome to TiKV"] [z=1] ["a b"=x] [m="{json"]
+
+
+[2021/08/04 12:00:43.129 Z] [warn] [<unknown>] [msg] [b=2] [a="1"]
+  backtrace`
+	var out bytes.Buffer
+	_, err := io.Copy(&out, NewNormalizingReader(strings.NewReader(log), WithParserOptions(WithAttachContinuations(true))))
+	assert.NoError(t, err)
+	assert.Equal(t, `[2021/08/04 04:00:43.128 Z] [INFO] [lib.rs:81] ["Welcome to TiKV"] ["a b"=x] [m="{json"] [z=1]
+[2021/08/04 12:00:43.129 Z] [WARN] [<unknown>] [msg] [a=1] [b=2]
+  backtrace
+`, out.String())
+
+	// Re-parse the output.
+	expect, err := ParseFromString(log, WithAttachContinuations(true))
+	assert.NoError(t, err)
+	entries, err := ParseFromString(out.String(), WithAttachContinuations(true))
+	assert.NoError(t, err)
+	assert.Len(t, entries, 2)
+	for i := range entries {
+		assert.True(t, entries[i].Header.DateTime.Equal(expect[i].Header.DateTime))
+		assert.Equal(t, len(expect[i].Fields), len(entries[i].Fields))
+		assert.Equal(t, expect[i].Message, entries[i].Message)
+		assert.Equal(t, expect[i].Continuation, entries[i].Continuation)
+	}
+
+	// Options, and reading one byte at a time.
+	shanghai, err := time.LoadLocation("Asia/Shanghai")
+	assert.NoError(t, err)
+	b, err := ioutil.ReadAll(iotest.OneByteReader(NewNormalizingReader(strings.NewReader(log),
+		WithOutputLocation(shanghai), WithSortedFields(false), WithParserOptions(WithAttachContinuations(true)))))
+	assert.NoError(t, err)
+	assert.Equal(t, `[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] ["Welcome to TiKV"] [z=1] ["a b"=x] [m="{json"]
+[2021/08/04 20:00:43.129 +08:00] [WARN] [<unknown>] [msg] [b=2] [a=1]
+  backtrace
+`, string(b))
+
+	// The entries before an error are read first.
+	b, err = ioutil.ReadAll(NewNormalizingReader(strings.NewReader(log)))
+	assert.Error(t, err)
+	assert.Equal(t, `[2021/08/04 04:00:43.128 Z] [INFO] [lib.rs:81] ["Welcome to TiKV"] ["a b"=x] [m="{json"] [z=1]
+[2021/08/04 12:00:43.129 Z] [WARN] [<unknown>] [msg] [a=1] [b=2]
+`, string(b))
+
+	// A literal ending with a backslash is quoted, so the output re-parses.
+	b, err = ioutil.ReadAll(NewNormalizingReader(strings.NewReader(`[2021/08/04 12:00:43.128 Z] [INFO] [lib.rs:81] [C:\temp\] [dir=a\]`)))
+	assert.NoError(t, err)
+	assert.Equal(t, `[2021/08/04 12:00:43.128 Z] [INFO] [lib.rs:81] ["C:\\temp\\"] [dir="a\\"]`+"\n", string(b))
+	entries, err = ParseFromString(string(b))
+	assert.NoError(t, err)
+	assert.Equal(t, `C:\temp\`, entries[0].Message)
+	assert.Equal(t, `a\`, entries[0].Fields[0].Value)
+}
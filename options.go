@@ -0,0 +1,447 @@
+package logparser
+
+import (
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Option configures a StreamParser. Options are passed to NewStreamParser.
+type Option func(*StreamParser)
+
+// WithMaxFields limits the number of fields a single log entry may have.
+// Parsing fails once an entry exceeds n fields. A value of 0 (the default)
+// means unlimited.
+func WithMaxFields(n int) Option {
+	return func(p *StreamParser) {
+		p.maxFields = n
+	}
+}
+
+// WithMaxMessageLen limits the length of a message, in runes. For quoted
+// messages the limit applies to the raw text between the quotes. A value
+// of 0 (the default) means unlimited.
+func WithMaxMessageLen(n int) Option {
+	return func(p *StreamParser) {
+		p.maxMessageLen = n
+	}
+}
+
+// WithUnbracketedMessage allows the message of a log entry to appear without
+// the surrounding brackets, e.g. `[...] [INFO] [lib.rs:81] Welcome to TiKV`.
+// If the token after file:line does not start with '[', the message extends
+// to the end of the line, or up to the first space followed by '[', which
+// starts the fields. Trailing spaces are dropped. A message starting with '['
+// is always parsed as a bracketed message.
+func WithUnbracketedMessage(enable bool) Option {
+	return func(p *StreamParser) {
+		p.unbracketedMessage = enable
+	}
+}
+
+// WithFieldSeparator sets the separator between the name and the value of
+// a field, e.g. ':' for fields like `[region_id:4]`. The default is '='.
+// An unquoted field name can not contain the separator, while an unquoted
+// value can, unless the separator is '='. In both, the separator and '=' can
+// be escaped by a backslash, like `[a\:b:c]`. Spaces around a separator other
+// than '=' are skipped, as in `[key: value]`.
+func WithFieldSeparator(sep rune) Option {
+	return func(p *StreamParser) {
+		p.fieldSep = sep
+	}
+}
+
+// WithLineBuffer enables the line buffer mode, in which ParseNext reads a
+// whole line into a reusable buffer first, and then parses the entry from
+// it. The message, field names and field values are sliced from a single
+// string copied from the buffer, instead of being allocated one by one,
+// which greatly reduces allocations for read-and-discard workloads.
+//
+// In this mode, the strings of a LogEntry are only guaranteed to be valid
+// until the next call to ParseNext. Use strings.Clone (or an equivalent) to
+// retain them. Besides, an entry must be contained in a single line, and
+// unexpected characters after the fields are reported as an error.
+func WithLineBuffer(enable bool) Option {
+	return func(p *StreamParser) {
+		p.lineBuffer = enable
+	}
+}
+
+// WithStrictDatetime rejects any timestamp whose components are out of
+// their valid ranges, e.g. `2021/13/01` or `2021/02/30`, which means the
+// parsed time would not reproduce the original text when formatted back.
+// The error names the offending component.
+func WithStrictDatetime(enable bool) Option {
+	return func(p *StreamParser) {
+		p.strictDatetime = enable
+	}
+}
+
+// WithLocation sets the location of all parsed timestamps. A timestamp
+// without zone, e.g. `[2021/08/04 12:00:43.128]`, is interpreted as a wall
+// clock time in loc, and a timestamp with zone is converted to loc. Without
+// this option, timestamps without zone are rejected, unless
+// WithDefaultLocation is set.
+func WithLocation(loc *time.Location) Option {
+	return func(p *StreamParser) {
+		p.location = loc
+	}
+}
+
+// WithAttachContinuations attaches the lines which do not start with a
+// bracketed datetime to the previous entry as LogEntry.Continuation, instead
+// of failing to parse them as new entries. This is useful for logs with
+// multi-line content like a backtrace after a panic. Empty lines are skipped.
+// A line starts a new entry if it begins with '[' and a digit, after
+// optional spaces.
+func WithAttachContinuations(enable bool) Option {
+	return func(p *StreamParser) {
+		p.attachContinuations = enable
+	}
+}
+
+// WithDoubledQuoteEscaping treats two consecutive quotes inside a quoted
+// string as one literal quote, as in CSV, e.g. `"say ""hi"""` is parsed as
+// `say "hi"`. Backslash escaping keeps working as well.
+func WithDoubledQuoteEscaping(enable bool) Option {
+	return func(p *StreamParser) {
+		p.doubledQuoteEscaping = enable
+	}
+}
+
+// WithOptionalFileLine allows the file:line of a log entry to be absent, e.g.
+// `[...] [INFO] ["Welcome"]`. The token after the level is taken as the
+// file:line only if it looks like one, that is `[name:line]` with a valid
+// file name, or `[<unknown>]`. Otherwise File and Line are left empty and
+// the token is parsed as the message. Note that a bare message like
+// `[main.go:12]` is always taken as a file:line.
+func WithOptionalFileLine(enable bool) Option {
+	return func(p *StreamParser) {
+		p.optionalFileLine = enable
+	}
+}
+
+// WithBracketBalancedBareValues allows an unquoted field value to contain
+// balanced brackets, e.g. `[key=vec[0]]` is parsed as the value `vec[0]`.
+// A '[' in the value opens a nested pair, and only a ']' which does not
+// close one ends the field. See WithBracketEscaping for a lighter-weight
+// alternative.
+func WithBracketBalancedBareValues(enable bool) Option {
+	return func(p *StreamParser) {
+		p.bracketBalancedBareValues = enable
+	}
+}
+
+// WithBracketEscaping allows a backslash to escape a bracket in an unquoted
+// message or field value, e.g. `[vec\[0\] done]` is parsed as the message
+// `vec[0] done`. The message delimiters set by WithMessageDelimiters can be
+// escaped the same way. It is disabled by default, so that a bare literal
+// may end with a backslash, like the Windows path in `[dir=C:\temp\]`.
+func WithBracketEscaping(enable bool) Option {
+	return func(p *StreamParser) {
+		p.bracketEscaping = enable
+	}
+}
+
+// WithBufferSize sets the size of the read buffer in bytes, which is 4096 by
+// default. A larger buffer saves reads for logs with very long entries. The
+// look-ahead of the parser is limited by the buffer size, so a tiny buffer
+// may make WithOptionalFileLine take a long message for a file:line.
+func WithBufferSize(n int) Option {
+	return func(p *StreamParser) {
+		p.bufferSize = n
+	}
+}
+
+// WithMessageDelimiters sets the runes enclosing the message, e.g. '{' and
+// '}' for entries like `[...] [INFO] [lib.rs:81] {Welcome}`. The default is
+// '[' and ']'. The delimiters of the other tokens and fields are unchanged.
+// An unquoted message ends at the closing delimiter.
+func WithMessageDelimiters(open, close rune) Option {
+	return func(p *StreamParser) {
+		p.msgOpen = open
+		p.msgClose = close
+	}
+}
+
+// WithConcurrencyCheck makes ParseNext and NextToken panic if they are
+// called while another call is in progress on the same parser, e.g. from
+// another goroutine. A StreamParser is not safe for concurrent use, and such
+// misuse would otherwise silently corrupt the parsed entries. This is a
+// debugging aid, off by default to keep the atomic operations out of the
+// hot path.
+func WithConcurrencyCheck(enable bool) Option {
+	return func(p *StreamParser) {
+		p.concurrencyCheck = enable
+	}
+}
+
+// WithLinePrefix strips a prefix from the beginning of each entry line, like
+// `host01 tikv: ` added by syslog, and stores it without trailing spaces in
+// LogEntry.Source. The prefix is the text matched by pattern at the start of
+// the line after leading spaces, so it may contain brackets as well, e.g.
+// `^\S+ \S+\[\d+\]: `. For a fixed separator sep, use
+// "^.*?" + regexp.QuoteMeta(sep) as the pattern. If pattern does not match,
+// the line is parsed as usual and Source is left empty. Only as much of the
+// line as fits into the read buffer is matched, see WithBufferSize.
+func WithLinePrefix(pattern *regexp.Regexp) Option {
+	return func(p *StreamParser) {
+		p.linePrefix = pattern
+	}
+}
+
+// WithWarningFunc sets a function to be called on recoverable oddities while
+// parsing, which are not worth an error, with the line number and a message.
+// Currently these are a log level not in upper case, e.g. `[Info]`, a field
+// name which appears more than once in an entry, a control character which
+// is stripped or replaced, see WithControlCharPolicy, and text after the
+// fields which is skipped with TrailingTokenIgnore.
+func WithWarningFunc(fn func(line int, msg string)) Option {
+	return func(p *StreamParser) {
+		p.warnFunc = fn
+	}
+}
+
+// WithStringInterning makes entries share a single string for each distinct
+// field name, like `region_id`, instead of allocating one per field. This
+// reduces the memory footprint of large result slices. Field values are not
+// interned. To bound the memory on adversarial input, up to 4096 names of up
+// to 128 bytes are interned per parser, other names are allocated as usual.
+func WithStringInterning(enable bool) Option {
+	return func(p *StreamParser) {
+		p.internNames = enable
+	}
+}
+
+// WithTrailingComment allows a free-form comment after the fields of an
+// entry, starting with prefix and extending to the end of the line, e.g.
+// `[...] [k=v] // deprecated path` with the prefix "//". The comment is
+// stored in LogEntry.Comment, without the prefix and surrounding spaces.
+func WithTrailingComment(prefix string) Option {
+	return func(p *StreamParser) {
+		p.commentPrefix = prefix
+	}
+}
+
+// WithEpochDatetime interprets the datetime of an entry as an integer number
+// of unit since the Unix epoch, e.g. `[1628049643128]` with time.Millisecond,
+// instead of the default layout. The parsed time is in UTC, or in the
+// location set by WithLocation.
+func WithEpochDatetime(unit time.Duration) Option {
+	return func(p *StreamParser) {
+		p.epochUnit = unit
+	}
+}
+
+// WithNormalizeUTC converts all parsed timestamps to UTC, so entries from
+// different zones are directly comparable. The original zone offset is kept
+// in LogHeader.OriginalOffset. By default, the zone of the log is kept.
+func WithNormalizeUTC(enable bool) Option {
+	return func(p *StreamParser) {
+		p.normalizeUTC = enable
+	}
+}
+
+// WithLastFieldGreedy lets the unquoted value of the last field on a line
+// contain spaces, like `[msg=connection reset by peer]`. If no '[' follows
+// the start of a value on its line, the value extends to the next ']' or the
+// end of the line.
+func WithLastFieldGreedy(enable bool) Option {
+	return func(p *StreamParser) {
+		p.lastFieldGreedy = enable
+	}
+}
+
+// WithStringLiteralValidator sets the function deciding which runes an
+// unquoted field value may contain, instead of the default, which allows
+// everything but control characters, spaces, '"', '=', '[' and ']'. The value
+// ends before the first rune rejected by valid. Field names and messages are
+// not affected. Keep '[', ']', the field separator and the line endings
+// rejected, or a value may run into the next field or line.
+func WithStringLiteralValidator(valid func(c rune) bool) Option {
+	return func(p *StreamParser) {
+		p.valueValidator = valid
+	}
+}
+
+// WithFieldNameTransform applies fn to the name of each parsed field, e.g.
+// strings.ToLower or a snake_case normalizer, so names with inconsistent
+// casing like `RegionID` and `region_id` can be grouped together. Field
+// values are left untouched. In line buffer mode, the name passed to fn is
+// only valid until the next call to ParseNext, like the parsed strings.
+func WithFieldNameTransform(fn func(name string) string) Option {
+	return func(p *StreamParser) {
+		p.fieldNameTransform = fn
+	}
+}
+
+// WithFlexibleTokenOrder allows fields to appear before the message, e.g.
+// `[...] [INFO] [lib.rs:81] [region_id=4] ["Welcome"]`. Each token after the
+// file:line is classified by whether it has the field separator outside of
+// quotes, and the first token which is not a field is taken as the message.
+// The fields before and after the message are stored in order. Note that a
+// bare message with the separator, like `[a:b]` with ':' as the separator, is
+// taken as a field in this mode.
+func WithFlexibleTokenOrder(enable bool) Option {
+	return func(p *StreamParser) {
+		p.flexibleTokenOrder = enable
+	}
+}
+
+// WithBlankLineFunc sets a function to be called with the number of
+// consecutive blank lines skipped before an entry, or before the end of the
+// stream, so a re-emitter can reproduce the original spacing. It is not called
+// if there are no blank lines. Blank lines between continuation lines are
+// not reported, see WithAttachContinuations.
+func WithBlankLineFunc(fn func(count int)) Option {
+	return func(p *StreamParser) {
+		p.blankLineFunc = fn
+	}
+}
+
+// ControlCharPolicy tells how control characters are handled, see
+// WithControlCharPolicy.
+type ControlCharPolicy int
+
+const (
+	// ControlCharReject fails to parse an entry with a control character.
+	// It is the default.
+	ControlCharReject ControlCharPolicy = iota
+	// ControlCharStrip drops control characters.
+	ControlCharStrip
+	// ControlCharReplace replaces each control character with a space.
+	ControlCharReplace
+)
+
+// WithControlCharPolicy sets how control characters below U+0020 other than
+// line breaks, like the NUL bytes of a corrupted log file, are handled in
+// messages, field names and field values, quoted or not. By default, they
+// are rejected with an error naming the character. A replacing space is
+// kept as a part of a bare literal, it does not end the literal.
+func WithControlCharPolicy(policy ControlCharPolicy) Option {
+	return func(p *StreamParser) {
+		p.controlCharPolicy = policy
+	}
+}
+
+// WithCommaFractionalSeconds accepts a comma before the fractional seconds of
+// a timestamp, as written by loggers in European locales, e.g.
+// `[2021/08/04 12:00:43,128 +08:00]`. The comma is normalized to '.', so
+// such timestamps are parsed like the default layout.
+func WithCommaFractionalSeconds(enable bool) Option {
+	return func(p *StreamParser) {
+		p.commaFractionalSeconds = enable
+	}
+}
+
+// WithMaxLineLength limits the length of a line in bytes, without the line
+// break. Parsing fails once a line exceeds n bytes, which bounds the memory
+// used for untrusted input, e.g. binary garbage without line breaks. A value
+// of 0 (the default) means unlimited.
+func WithMaxLineLength(n int) Option {
+	return func(p *StreamParser) {
+		p.maxLineLength = n
+	}
+}
+
+// WithDefaultLocation sets the location of the timestamps without zone, e.g.
+// `[2021/08/04 12:00:43.128]`, which are rejected by default. Unlike
+// WithLocation, timestamps with zone are kept in their zone. If both are set,
+// WithLocation takes precedence.
+func WithDefaultLocation(loc *time.Location) Option {
+	return func(p *StreamParser) {
+		p.defaultLocation = loc
+	}
+}
+
+// WithLevelAliases maps additional textual log levels onto the canonical ones,
+// e.g. "CRITICAL" to LogLevelFatal and "NOTICE" to LogLevelInfo. Aliases are
+// case insensitive and are looked up before the built-in names, which keep
+// working. A log level may be up to 16 bytes long.
+func WithLevelAliases(aliases map[string]LogLevel) Option {
+	return func(p *StreamParser) {
+		p.levelAliases = make(map[string]LogLevel, len(aliases))
+		for name, level := range aliases {
+			p.levelAliases[strings.ToUpper(name)] = level
+		}
+	}
+}
+
+// WithUnbracketedDatetime parses the datetime at the beginning of an entry
+// without the surrounding brackets, e.g. `2021/08/04 12:00:43.128 +08:00
+// [INFO] [lib.rs:81] [msg]`. Since the datetime contains spaces, it extends
+// to the space before the '[' of the level. With WithAttachContinuations, a
+// line starts a new entry if it begins with a digit, after optional spaces.
+func WithUnbracketedDatetime(enable bool) Option {
+	return func(p *StreamParser) {
+		p.unbracketedDatetime = enable
+	}
+}
+
+// WithDateTimeParser replaces the built-in parsing of the datetime with fn,
+// which receives the raw text between the brackets, e.g. for exotic formats.
+// The characters of the datetime are not validated then, except that it can
+// not contain a line break. WithStrictDatetime, WithLocation, WithEpochDatetime
+// and the like have no effect on fn, while WithNormalizeUTC still applies to
+// the returned time.
+func WithDateTimeParser(fn func(token string) (time.Time, error)) Option {
+	return func(p *StreamParser) {
+		p.datetimeParser = fn
+	}
+}
+
+// WithFlexibleWhitespace accepts any run of spaces and tabs between the
+// tokens of an entry, e.g. for tab-aligned logs, instead of exactly one space
+// between the header tokens and spaces only before the fields. Leading spaces
+// of a line are not affected.
+func WithFlexibleWhitespace(enable bool) Option {
+	return func(p *StreamParser) {
+		p.flexibleWhitespace = enable
+	}
+}
+
+// WithAssumeSorted declares that the entries are sorted by their DateTime,
+// which lets ParseTimeWindow stop at the end of the window instead of
+// parsing the rest of the stream.
+func WithAssumeSorted(enable bool) Option {
+	return func(p *StreamParser) {
+		p.assumeSorted = enable
+	}
+}
+
+// WithPartialEntries makes ParseNext and ParseInto return the entry parsed so
+// far with LogEntry.Partial set, instead of an error matching
+// ErrIncompleteEntry, when the stream ends in the middle of the entry, e.g.
+// when tailing a log whose last line is still being written. The tokens after
+// the truncation are left zero, and so is a token cut off itself, like a
+// field missing its closing bracket.
+func WithPartialEntries(enable bool) Option {
+	return func(p *StreamParser) {
+		p.partialEntries = enable
+	}
+}
+
+// TrailingTokenPolicy tells how the text after the fields of an entry is
+// handled, see WithTrailingTokenPolicy.
+type TrailingTokenPolicy int
+
+const (
+	// TrailingTokenReject fails to parse an entry with text after the fields.
+	// It is the default.
+	TrailingTokenReject TrailingTokenPolicy = iota
+	// TrailingTokenIgnore skips the text up to the end of the line.
+	TrailingTokenIgnore
+	// TrailingTokenCapture stores the text up to the end of the line in
+	// LogEntry.Trailer, without trailing spaces.
+	TrailingTokenCapture
+)
+
+// WithTrailingTokenPolicy sets how unexpected text after the fields of an
+// entry, like `[k=v] (retried)` appended by a wrapper script, is handled. By
+// default, it is rejected with an error naming the first character. A
+// comment set by WithTrailingComment is not affected.
+func WithTrailingTokenPolicy(policy TrailingTokenPolicy) Option {
+	return func(p *StreamParser) {
+		p.trailingTokenPolicy = policy
+	}
+}
@@ -0,0 +1,985 @@
+package logparser
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWithMaxFields(t *testing.T) {
+	log := `[2021/08/04 12:00:43.129 +08:00] [DEBUG] [<unknown>] [test_message] [k1=v1] [k2=v2] [k3=v3]`
+	parser := NewStreamParser(strings.NewReader(log), WithMaxFields(3))
+	entry, err := parser.ParseNext()
+	assert.NoError(t, err)
+	assert.Len(t, entry.Fields, 3)
+	parser = NewStreamParser(strings.NewReader(log), WithMaxFields(2))
+	_, err = parser.ParseNext()
+	assert.EqualError(t, err, "invalid log format at line 1, column 85, cause: too many fields, limit is 2")
+}
+
+func TestWithMaxMessageLen(t *testing.T) {
+	parser := NewStreamParser(strings.NewReader(`[connecting]`), WithMaxMessageLen(10))
+	msg, err := parser.parseMessage()
+	assert.NoError(t, err)
+	assert.Equal(t, "connecting", msg)
+	parser = NewStreamParser(strings.NewReader(`[connecting]`), WithMaxMessageLen(9))
+	_, err = parser.parseMessage()
+	assert.EqualError(t, err, "message too long, limit is 9")
+	parser = NewStreamParser(strings.NewReader(`["connecting"]`), WithMaxMessageLen(10))
+	msg, err = parser.parseMessage()
+	assert.NoError(t, err)
+	assert.Equal(t, "connecting", msg)
+	parser = NewStreamParser(strings.NewReader(`["connecting"]`), WithMaxMessageLen(9))
+	_, err = parser.parseMessage()
+	assert.EqualError(t, err, "message too long, limit is 9")
+	// Field values are not limited.
+	parser = NewStreamParser(strings.NewReader(`[2021/08/04 12:00:43.129 +08:00] [INFO] [<unknown>] [msg] [key=a_long_value]`), WithMaxMessageLen(3))
+	entry, err := parser.ParseNext()
+	assert.NoError(t, err)
+	assert.Equal(t, "a_long_value", entry.Fields[0].Value)
+}
+
+func TestWithUnbracketedMessage(t *testing.T) {
+	entries, err := ParseFromString(`[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] Welcome to TiKV
+[2021/08/04 12:00:43.129 +08:00] [INFO] [lib.rs:86] Release Version: 5.1.0 [k1=v1] [k2=v2]
+[2021/08/04 12:00:43.129 +08:00] [INFO] [lib.rs:86] trailing spaces   
+[2021/08/04 12:00:43.129 +08:00] [INFO] [lib.rs:86] a[b] c [k=v]
+[2021/08/04 12:00:43.129 +08:00] [INFO] [lib.rs:86] ["bracketed"] [k=v]`, WithUnbracketedMessage(true))
+	assert.NoError(t, err)
+	assert.Len(t, entries, 5)
+	assert.Equal(t, "Welcome to TiKV", entries[0].Message)
+	assert.Len(t, entries[0].Fields, 0)
+	assert.Equal(t, "Release Version: 5.1.0", entries[1].Message)
+	assert.Equal(t, []LogField{{Name: "k1", Value: "v1"}, {Name: "k2", Value: "v2"}}, entries[1].Fields)
+	assert.Equal(t, "trailing spaces", entries[2].Message)
+	assert.Equal(t, "a[b] c", entries[3].Message)
+	assert.Equal(t, []LogField{{Name: "k", Value: "v"}}, entries[3].Fields)
+	assert.Equal(t, "bracketed", entries[4].Message)
+	assert.Equal(t, []LogField{{Name: "k", Value: "v"}}, entries[4].Fields)
+
+	_, err = ParseFromString(`[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] Welcome to TiKV`)
+	assert.Error(t, err)
+
+	// With WithFlexibleWhitespace, tabs may separate the message from the
+	// fields as well.
+	log := "[2021/08/04 12:00:43.128 +08:00]\t[INFO]\t[lib.rs:81]\tWelcome to TiKV\t[k=v] \t[a=b]\n" +
+		"[2021/08/04 12:00:43.129 +08:00]\t[INFO]\t[lib.rs:86]\tRelease Version: 5.1.0 \t\n" +
+		"[2021/08/04 12:00:43.129 +08:00]\t[INFO]\t[lib.rs:86]\ta[b]\t\t[k=v]"
+	for _, opts := range [][]Option{
+		{WithUnbracketedMessage(true), WithFlexibleWhitespace(true)},
+		{WithUnbracketedMessage(true), WithFlexibleWhitespace(true), WithLineBuffer(true)},
+	} {
+		entries, err := ParseFromString(log, opts...)
+		assert.NoError(t, err)
+		assert.Len(t, entries, 3)
+		assert.Equal(t, "Welcome to TiKV", entries[0].Message)
+		assert.Equal(t, []LogField{{Name: "k", Value: "v"}, {Name: "a", Value: "b"}}, entries[0].Fields)
+		assert.Equal(t, "Release Version: 5.1.0", entries[1].Message)
+		assert.Len(t, entries[1].Fields, 0)
+		assert.Equal(t, "a[b]", entries[2].Message)
+		assert.Equal(t, []LogField{{Name: "k", Value: "v"}}, entries[2].Fields)
+	}
+}
+
+func TestWithFieldSeparator(t *testing.T) {
+	entries, err := ParseFromString(`[2021/08/04 12:00:43.129 +08:00] [INFO] [lib.rs:86] [msg] [region_id:4] [endpoints:127.0.0.1:2379] ["a:b":"c:d"]`, WithFieldSeparator(':'))
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1)
+	assert.Equal(t, []LogField{
+		{Name: "region_id", Value: "4"},
+		{Name: "endpoints", Value: "127.0.0.1:2379"},
+		{Name: "a:b", Value: "c:d", ValueQuoted: true},
+	}, entries[0].Fields)
+	_, err = ParseFromString(`[2021/08/04 12:00:43.129 +08:00] [INFO] [lib.rs:86] [msg] [region_id=4]`, WithFieldSeparator(':'))
+	assert.Error(t, err)
+
+	// Spaces around the separator.
+	for _, field := range []string{"[k: v]", "[k:v]", "[k :v]", "[k  :  v]"} {
+		for _, opt := range []Option{WithLineBuffer(false), WithLineBuffer(true)} {
+			entries, err := ParseFromString(`[2021/08/04 12:00:43.129 +08:00] [INFO] [lib.rs:86] [msg] `+field, WithFieldSeparator(':'), opt)
+			assert.NoError(t, err, field)
+			if assert.Len(t, entries, 1, field) {
+				assert.Equal(t, []LogField{{Name: "k", Value: "v"}}, entries[0].Fields, field)
+			}
+		}
+	}
+	_, err = ParseFromString(`[2021/08/04 12:00:43.129 +08:00] [INFO] [lib.rs:86] [msg] [k = v]`)
+	assert.Error(t, err)
+}
+
+func TestWithLineBuffer(t *testing.T) {
+	log := "\r\n[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] [\"Welcome to TiKV\"]\r\n" +
+		"[2021/08/04 12:00:43.129 +08:00] [DEBUG] [<unknown>] [test_message] [test_k1=test_v1] [\"test k2\"=\"test \\\"v2\\\"\"]  \n\n" +
+		"  [2021/08/04 12:00:43.129 +08:00] [WARN] [lib.rs:86] [\"Release \\u0056ersion:   5.1.0-alpha\"] [\"值\"=值]"
+	expect, err := ParseFromString(log)
+	assert.NoError(t, err)
+	assert.Len(t, expect, 3)
+	parser := NewStreamParser(strings.NewReader(log), WithLineBuffer(true))
+	for _, e := range expect {
+		entry, err := parser.ParseNext()
+		assert.NoError(t, err)
+		assert.True(t, e.Equal(entry), "%v != %v", e, entry)
+	}
+	entry, err := parser.ParseNext()
+	assert.NoError(t, err)
+	assert.Nil(t, entry)
+	assert.Equal(t, 5, parser.line)
+
+	content, err := ioutil.ReadFile("benches/bench_100k.log")
+	assert.NoError(t, err)
+	expect, err = ParseFromBytes(content)
+	assert.NoError(t, err)
+	entries, err := ParseFromBytes(content, WithLineBuffer(true))
+	assert.NoError(t, err)
+	assert.Equal(t, len(expect), len(entries))
+	for i := range expect {
+		assert.True(t, expect[i].Equal(entries[i]))
+	}
+
+	// Trailing characters would be lost, so they are reported.
+	_, err = ParseFromString("[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] [msg] xxx", WithLineBuffer(true))
+	assert.EqualError(t, err, "invalid log format at line 1, column 59, cause: unexpected character 'x'")
+	// An entry must be contained in a single line.
+	_, err = ParseFromString("[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81]\n[msg]", WithLineBuffer(true))
+	assert.Error(t, err)
+}
+
+func TestWithAttachContinuations(t *testing.T) {
+	log := `[2021/08/04 12:00:43.128 +08:00] [FATAL] [lib.rs:465] ["thread 'main' panicked"] [location=src/main.rs:10]
+   0: tikv_util::set_panic_hook::{{closure}}
+             at components/tikv_util/src/lib.rs:464
+
+   1: std::panicking::rust_panic_with_hook` + "\r\n" + `[2021/08/04 12:00:43.129 +08:00] [INFO] [lib.rs:86] [next]
+[2021/08/04 12:00:43.129 +08:00] [INFO] [lib.rs:86] [last]
+tail`
+	for _, opts := range [][]Option{
+		{WithAttachContinuations(true)},
+		{WithAttachContinuations(true), WithLineBuffer(true)},
+	} {
+		parser := NewStreamParser(strings.NewReader(log), opts...)
+		entry, err := parser.ParseNext()
+		assert.NoError(t, err)
+		assert.Equal(t, LogLevelFatal, entry.Header.Level)
+		assert.Equal(t, []LogField{{Name: "location", Value: "src/main.rs:10"}}, entry.Fields)
+		assert.Equal(t, []string{
+			"   0: tikv_util::set_panic_hook::{{closure}}",
+			"             at components/tikv_util/src/lib.rs:464",
+			"   1: std::panicking::rust_panic_with_hook",
+		}, entry.Continuation)
+		entry, err = parser.ParseNext()
+		assert.NoError(t, err)
+		assert.Equal(t, "next", entry.Message)
+		assert.Nil(t, entry.Continuation)
+		assert.Equal(t, 7, parser.line)
+		entry, err = parser.ParseNext()
+		assert.NoError(t, err)
+		assert.Equal(t, "last", entry.Message)
+		assert.Equal(t, []string{"tail"}, entry.Continuation)
+		entry, err = parser.ParseNext()
+		assert.NoError(t, err)
+		assert.Nil(t, entry)
+	}
+
+	_, err := ParseFromString(log)
+	assert.Error(t, err)
+}
+
+func TestWithDoubledQuoteEscaping(t *testing.T) {
+	for _, c := range []struct {
+		literal string
+		expect  string
+		rest    string
+	}{
+		{`"say ""hi""" [k=v]`, `say "hi"`, " [k=v]"},
+		{`"""" x`, `"`, " x"},
+		{`"" x`, ``, " x"},
+		{`"a\"b""c\\" x`, `a"b"c\`, " x"},
+	} {
+		parser := NewStreamParser(strings.NewReader(c.literal), WithDoubledQuoteEscaping(true))
+		s, err := parser.parseStringJson(literalMessage)
+		assert.NoError(t, err, c.literal)
+		assert.Equal(t, c.expect, s, c.literal)
+		rest, _ := parser.br.ReadString('\n')
+		assert.Equal(t, c.rest, rest, c.literal)
+	}
+	log := `[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] ["say ""hi"""] [k="a""b"] [plain="c"]`
+	for _, opts := range [][]Option{
+		{WithDoubledQuoteEscaping(true)},
+		{WithDoubledQuoteEscaping(true), WithLineBuffer(true)},
+	} {
+		entries, err := ParseFromString(log, opts...)
+		assert.NoError(t, err)
+		assert.Equal(t, `say "hi"`, entries[0].Message)
+		assert.Equal(t, []LogField{{Name: "k", Value: `a"b`, ValueQuoted: true}, {Name: "plain", Value: "c", ValueQuoted: true}}, entries[0].Fields)
+	}
+	_, err := ParseFromString(log)
+	assert.Error(t, err)
+}
+
+func TestWithOptionalFileLine(t *testing.T) {
+	log := `[2021/08/04 12:00:43.128 +08:00] [INFO] ["Welcome"] [k=v]
+[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] ["Welcome"]
+[2021/08/04 12:00:43.128 +08:00] [INFO] [<unknown>] [connecting]
+[2021/08/04 12:00:43.128 +08:00] [INFO] [connecting] [k=v]
+[2021/08/04 12:00:43.128 +08:00] [INFO] [C:\src\main.go:12] [msg]
+[2021/08/04 12:00:43.128 +08:00] [INFO] [note:x] [k=v]
+[2021/08/04 12:00:43.128 +08:00] [INFO] [<b>] [k=v]
+[2021/08/04 12:00:43.128 +08:00] [INFO] [<unknown>] [<b>]`
+	for _, opts := range [][]Option{
+		{WithOptionalFileLine(true)},
+		{WithOptionalFileLine(true), WithLineBuffer(true)},
+		{WithOptionalFileLine(true), WithBufferSize(16)},
+	} {
+		entries, err := ParseFromString(log, opts...)
+		assert.NoError(t, err)
+		assert.Len(t, entries, 8)
+		for i, expect := range []struct {
+			file    string
+			line    int
+			message string
+		}{
+			{"", 0, "Welcome"},
+			{"lib.rs", 81, "Welcome"},
+			{"", 0, "connecting"},
+			{"", 0, "connecting"},
+			{`C:\src\main.go`, 12, "msg"},
+			{"", 0, "note:x"},
+			{"", 0, "<b>"},
+			{"", 0, "<b>"},
+		} {
+			assert.Equal(t, expect.file, entries[i].Header.File, i)
+			assert.Equal(t, expect.line, entries[i].Header.Line, i)
+			assert.Equal(t, expect.message, entries[i].Message, i)
+		}
+	}
+	_, err := ParseFromString(log)
+	assert.Error(t, err)
+
+	entries, err := ParseFromString(`[2021/08/04 12:00:43.128 +08:00] [INFO] Welcome to TiKV`, WithOptionalFileLine(true), WithUnbracketedMessage(true))
+	assert.NoError(t, err)
+	assert.Equal(t, "Welcome to TiKV", entries[0].Message)
+}
+
+func TestWithBracketBalancedBareValues(t *testing.T) {
+	for _, c := range []struct {
+		field  string
+		expect LogField
+	}{
+		{`[key=vec[0]]`, LogField{Name: "key", Value: "vec[0]"}},
+		{`[key=a[b[c]d]e]`, LogField{Name: "key", Value: "a[b[c]d]e"}},
+		{`[key=[]]`, LogField{Name: "key", Value: "[]"}},
+		{`[key=plain]`, LogField{Name: "key", Value: "plain"}},
+		{`[key="quoted]"]`, LogField{Name: "key", Value: "quoted]", ValueQuoted: true}},
+	} {
+		log := `[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] [msg] ` + c.field + ` [k=v]`
+		for _, opts := range [][]Option{
+			{WithBracketBalancedBareValues(true)},
+			{WithBracketBalancedBareValues(true), WithLineBuffer(true)},
+		} {
+			entries, err := ParseFromString(log, opts...)
+			assert.NoError(t, err, c.field)
+			assert.Equal(t, []LogField{c.expect, {Name: "k", Value: "v"}}, entries[0].Fields, c.field)
+		}
+	}
+
+	// Unbalanced brackets.
+	for _, field := range []string{`[key=vec[0]`, `[key=vec[0 ]`} {
+		log := `[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] [msg] ` + field
+		_, err := ParseFromString(log, WithBracketBalancedBareValues(true))
+		assert.Error(t, err, field)
+	}
+	_, err := ParseFromString(`[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] [msg] [key=vec[0]]`)
+	assert.Error(t, err)
+}
+
+func TestWithBracketEscaping(t *testing.T) {
+	log := `[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] [vec\[0\]] [k=a\[1\]b] [x=\]]`
+	for _, opts := range [][]Option{
+		{WithBracketEscaping(true)},
+		{WithBracketEscaping(true), WithLineBuffer(true)},
+		{WithBracketEscaping(true), WithBracketBalancedBareValues(true)},
+	} {
+		entries, err := ParseFromString(log, opts...)
+		assert.NoError(t, err)
+		assert.Equal(t, "vec[0]", entries[0].Message)
+		assert.Equal(t, []LogField{{Name: "k", Value: "a[1]b"}, {Name: "x", Value: "]"}}, entries[0].Fields)
+	}
+	entries, err := ParseFromString(`[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] {a\}b\{c}`,
+		WithMessageDelimiters('{', '}'), WithBracketEscaping(true))
+	assert.NoError(t, err)
+	assert.Equal(t, "a}b{c", entries[0].Message)
+
+	// Not in a field name, and an unescaped bracket still ends the literal.
+	for _, log := range []string{
+		`[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] [msg] [a\]=b]`,
+		`[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] [vec[0]]`,
+	} {
+		_, err := ParseFromString(log, WithBracketEscaping(true))
+		assert.Error(t, err, log)
+	}
+}
+
+func TestWithBufferSize(t *testing.T) {
+	log := `[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] ["Welcome to TiKV"] [k=v]
+  backtrace line
+[2021/08/04 12:00:43.128 +08:00] [INFO] ["no file line"]`
+	expect, err := ParseFromString(log, WithAttachContinuations(true), WithOptionalFileLine(true))
+	assert.NoError(t, err)
+	for _, size := range []int{16, 64, 1 << 20} {
+		parser := NewStreamParser(strings.NewReader(log), WithBufferSize(size), WithAttachContinuations(true), WithOptionalFileLine(true))
+		assert.Equal(t, size, parser.br.Size())
+		for _, e := range expect {
+			entry, err := parser.ParseNext()
+			assert.NoError(t, err)
+			assert.Equal(t, e, entry)
+		}
+		entry, err := parser.ParseNext()
+		assert.NoError(t, err)
+		assert.Nil(t, entry)
+	}
+}
+
+func TestWithMessageDelimiters(t *testing.T) {
+	log := `[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] {Welcome} [k=v]
+[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] {"{quoted} [message]"} [k={v}]
+[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] {}`
+	for _, opts := range [][]Option{
+		{WithMessageDelimiters('{', '}')},
+		{WithMessageDelimiters('{', '}'), WithLineBuffer(true)},
+		{WithMessageDelimiters('{', '}'), WithOptionalFileLine(true)},
+		{WithMessageDelimiters('{', '}'), WithUnbracketedMessage(true)},
+	} {
+		entries, err := ParseFromString(log, opts...)
+		assert.NoError(t, err)
+		assert.Len(t, entries, 3)
+		assert.Equal(t, "Welcome", entries[0].Message)
+		assert.Equal(t, []LogField{{Name: "k", Value: "v"}}, entries[0].Fields)
+		assert.Equal(t, "{quoted} [message]", entries[1].Message)
+		assert.Equal(t, []LogField{{Name: "k", Value: "{v}"}}, entries[1].Fields)
+		assert.Equal(t, "", entries[2].Message)
+	}
+	_, err := ParseFromString(log)
+	assert.Error(t, err)
+
+	entries, err := ParseFromString(`[2021/08/04 12:00:43.128 +08:00] [INFO] {Welcome}`, WithMessageDelimiters('{', '}'), WithOptionalFileLine(true))
+	assert.NoError(t, err)
+	assert.Equal(t, "", entries[0].Header.File)
+	assert.Equal(t, "Welcome", entries[0].Message)
+	entries, err = ParseFromString(`[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] Welcome to TiKV [k=v]`, WithMessageDelimiters('{', '}'), WithUnbracketedMessage(true))
+	assert.NoError(t, err)
+	assert.Equal(t, "Welcome to TiKV", entries[0].Message)
+}
+
+func TestWithConcurrencyCheck(t *testing.T) {
+	pr, pw := io.Pipe()
+	parser := NewStreamParser(pr, WithConcurrencyCheck(true))
+	done := make(chan *LogEntry)
+	go func() {
+		entry, err := parser.ParseNext()
+		assert.NoError(t, err)
+		done <- entry
+	}()
+	// Wait for the first call to block on reading.
+	for atomic.LoadInt32(&parser.busy) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	assert.PanicsWithValue(t, "logparser: concurrent use of a StreamParser", func() {
+		_, _ = parser.ParseNext()
+	})
+	assert.Panics(t, func() {
+		_, _ = parser.NextToken()
+	})
+	_, err := pw.Write([]byte("[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] [Welcome]\n"))
+	assert.NoError(t, err)
+	assert.NoError(t, pw.Close())
+	entry := <-done
+	assert.Equal(t, "Welcome", entry.Message)
+
+	// Sequential calls are fine.
+	entry, err = parser.ParseNext()
+	assert.NoError(t, err)
+	assert.Nil(t, entry)
+}
+
+func TestWithLinePrefix(t *testing.T) {
+	log := `host01 tikv: [2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] ["Welcome to TiKV"]
+host02 tikv[1234]: [2021/08/04 12:00:43.129 +08:00] [WARN] [lib.rs:82] [hello] [k=v]
+[2021/08/04 12:00:43.130 +08:00] [INFO] [lib.rs:83] [no_prefix]
+  host03 tikv: [2021/08/04 12:00:43.131 +08:00] [INFO] [lib.rs:84] [spaces]`
+	pattern := regexp.MustCompile(`^\S+ \S+: `)
+	for _, opts := range [][]Option{
+		{WithLinePrefix(pattern)},
+		{WithLinePrefix(pattern), WithLineBuffer(true)},
+	} {
+		entries, err := ParseFromString(log, opts...)
+		assert.NoError(t, err)
+		assert.Len(t, entries, 4)
+		assert.Equal(t, "host01 tikv:", entries[0].Source)
+		assert.Equal(t, "Welcome to TiKV", entries[0].Message)
+		assert.Equal(t, "host02 tikv[1234]:", entries[1].Source)
+		assert.Equal(t, []LogField{{Name: "k", Value: "v"}}, entries[1].Fields)
+		assert.Equal(t, "", entries[2].Source)
+		assert.Equal(t, "no_prefix", entries[2].Message)
+		assert.Equal(t, "host03 tikv:", entries[3].Source)
+	}
+	_, err := ParseFromString(log)
+	assert.Error(t, err)
+
+	// A fixed separator.
+	entries, err := ParseFromString(`a [b] tikv: [2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] [msg]`,
+		WithLinePrefix(regexp.MustCompile("^.*?"+regexp.QuoteMeta("tikv: "))))
+	assert.NoError(t, err)
+	assert.Equal(t, "a [b] tikv:", entries[0].Source)
+
+	// Continuations are told apart from prefixed entries.
+	entries, err = ParseFromString(`host01 tikv: [2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] [msg]
+  at main.rs:1
+host01 tikv: [2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] [msg]`,
+		WithLinePrefix(pattern), WithAttachContinuations(true))
+	assert.NoError(t, err)
+	assert.Len(t, entries, 2)
+	assert.Equal(t, []string{"  at main.rs:1"}, entries[0].Continuation)
+	assert.Equal(t, "host01 tikv:", entries[1].Source)
+}
+
+func TestWithWarningFunc(t *testing.T) {
+	log := `[2021/08/04 12:00:43.128 +08:00] [Info] [lib.rs:81] [msg] [k=v]
+[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] [msg] [k=v] [a=b] [k=w]
+[2021/08/04 12:00:43.128 +08:00] [WARN] [lib.rs:81] [msg] [k=v]`
+	var warnings []string
+	entries, err := ParseFromString(log, WithWarningFunc(func(line int, msg string) {
+		warnings = append(warnings, fmt.Sprintf("%d: %s", line, msg))
+	}))
+	assert.NoError(t, err)
+	assert.Len(t, entries, 3)
+	assert.Equal(t, []string{
+		"1: log level 'Info' is not upper case",
+		"2: duplicate field 'k'",
+	}, warnings)
+
+	// Nil is fine.
+	_, err = ParseFromString(log, WithWarningFunc(nil))
+	assert.NoError(t, err)
+
+	// Skipped and normalized text.
+	warnings = nil
+	_, err = ParseFromString("[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] [a\x07b] [k=v] extra \n"+
+		"[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] [msg]",
+		WithControlCharPolicy(ControlCharStrip), WithTrailingTokenPolicy(TrailingTokenIgnore),
+		WithWarningFunc(func(line int, msg string) {
+			warnings = append(warnings, fmt.Sprintf("%d: %s", line, msg))
+		}))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		"1: control character U+0007 is stripped",
+		"1: trailing text 'extra' is skipped",
+	}, warnings)
+	warnings = nil
+	_, err = ParseFromString("[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] [a\x07b]",
+		WithControlCharPolicy(ControlCharReplace), WithWarningFunc(func(line int, msg string) {
+			warnings = append(warnings, fmt.Sprintf("%d: %s", line, msg))
+		}))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"1: control character U+0007 is replaced"}, warnings)
+}
+
+func TestWithStringInterning(t *testing.T) {
+	log := `[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] [msg] [region_id=1] ["peer id"=2]
+[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] [msg] [region_id=region_id] ["peer id"=3]`
+	for _, opts := range [][]Option{
+		{WithStringInterning(true)},
+		{WithStringInterning(true), WithLineBuffer(true)},
+	} {
+		entries, err := ParseFromString(log, opts...)
+		assert.NoError(t, err)
+		assert.Equal(t, []LogField{{Name: "region_id", Value: "1"}, {Name: "peer id", Value: "2"}}, entries[0].Fields)
+		assert.Equal(t, []LogField{{Name: "region_id", Value: "region_id"}, {Name: "peer id", Value: "3"}}, entries[1].Fields)
+		assert.True(t, sameString(entries[0].Fields[0].Name, entries[1].Fields[0].Name))
+		assert.True(t, sameString(entries[0].Fields[1].Name, entries[1].Fields[1].Name))
+		// Values are not interned.
+		assert.False(t, sameString(entries[1].Fields[0].Name, entries[1].Fields[0].Value))
+	}
+	entries, err := ParseFromString(log)
+	assert.NoError(t, err)
+	assert.False(t, sameString(entries[0].Fields[0].Name, entries[1].Fields[0].Name))
+
+	// The table is bounded.
+	var b strings.Builder
+	for i := 0; i < maxInternedNames+10; i++ {
+		fmt.Fprintf(&b, "[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] [msg] [k%d=v] [%s=v]\n", i, strings.Repeat("x", maxInternedNameLen+1))
+	}
+	parser := NewStreamParser(strings.NewReader(b.String()), WithStringInterning(true))
+	for {
+		entry, err := parser.ParseNext()
+		assert.NoError(t, err)
+		if entry == nil {
+			break
+		}
+	}
+	assert.Len(t, parser.internTable, maxInternedNames)
+}
+
+// sameString reports whether a and b share the same memory.
+func sameString(a, b string) bool {
+	ha := (*reflect.StringHeader)(unsafe.Pointer(&a))
+	hb := (*reflect.StringHeader)(unsafe.Pointer(&b))
+	return ha.Data == hb.Data && ha.Len == hb.Len
+}
+
+func TestWithTrailingComment(t *testing.T) {
+	log := `[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] [msg] [k=v] // deprecated path
+[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] [msg] [k=v]
+[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] [msg]   //no space [x=y]  
+  backtrace
+[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] [msg] //`
+	for _, opts := range [][]Option{
+		{WithTrailingComment("//"), WithAttachContinuations(true)},
+		{WithTrailingComment("//"), WithAttachContinuations(true), WithLineBuffer(true)},
+	} {
+		entries, err := ParseFromString(log, opts...)
+		assert.NoError(t, err)
+		assert.Len(t, entries, 4)
+		assert.Equal(t, "deprecated path", entries[0].Comment)
+		assert.Equal(t, []LogField{{Name: "k", Value: "v"}}, entries[0].Fields)
+		assert.Equal(t, "", entries[1].Comment)
+		assert.Equal(t, "no space [x=y]", entries[2].Comment)
+		assert.Empty(t, entries[2].Fields)
+		assert.Equal(t, []string{"  backtrace"}, entries[2].Continuation)
+		assert.Equal(t, "", entries[3].Comment)
+	}
+	_, err := ParseFromString(log, WithAttachContinuations(true), WithLineBuffer(true))
+	assert.Error(t, err)
+	_, err = ParseFromString(`[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] [msg] # comment`, WithTrailingComment("//"), WithLineBuffer(true))
+	assert.Error(t, err)
+}
+
+func TestWithLastFieldGreedy(t *testing.T) {
+	log := `[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] [msg] [k=v] [err=connection reset by peer]
+[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] [msg] [err=a = "b"]  
+[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] [msg] [k=v] [err="quoted value"]`
+	for _, opts := range [][]Option{
+		{WithLastFieldGreedy(true)},
+		{WithLastFieldGreedy(true), WithLineBuffer(true)},
+	} {
+		entries, err := ParseFromString(log, opts...)
+		assert.NoError(t, err)
+		assert.Len(t, entries, 3)
+		assert.Equal(t, []LogField{{Name: "k", Value: "v"}, {Name: "err", Value: "connection reset by peer"}}, entries[0].Fields)
+		assert.Equal(t, []LogField{{Name: "err", Value: `a = "b"`}}, entries[1].Fields)
+		assert.Equal(t, []LogField{{Name: "k", Value: "v"}, {Name: "err", Value: "quoted value", ValueQuoted: true}}, entries[2].Fields)
+	}
+	_, err := ParseFromString(log)
+	assert.Error(t, err)
+
+	// Only the last field is greedy.
+	_, err = ParseFromString(`[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] [msg] [err=reset by peer] [k=v]`, WithLastFieldGreedy(true))
+	assert.Error(t, err)
+}
+
+func TestWithStringLiteralValidator(t *testing.T) {
+	log := `[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] [msg] [url=http://host/?a=1&b=%20] [k=v]`
+	allowEqual := func(c rune) bool {
+		return c == '=' || validStringLiteralChar(c)
+	}
+	for _, opts := range [][]Option{
+		{WithStringLiteralValidator(allowEqual)},
+		{WithStringLiteralValidator(allowEqual), WithLineBuffer(true)},
+	} {
+		entries, err := ParseFromString(log, opts...)
+		assert.NoError(t, err)
+		assert.Len(t, entries, 1)
+		assert.Equal(t, []LogField{{Name: "url", Value: "http://host/?a=1&b=%20"}, {Name: "k", Value: "v"}}, entries[0].Fields)
+	}
+	_, err := ParseFromString(log)
+	assert.Error(t, err)
+
+	// Field names are not affected.
+	_, err = ParseFromString(`[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] [msg] [a%b=c]`, WithStringLiteralValidator(func(c rune) bool {
+		return c != '%' && validStringLiteralChar(c)
+	}))
+	assert.NoError(t, err)
+	_, err = ParseFromString(`[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] [msg] [c=a%b]`, WithStringLiteralValidator(func(c rune) bool {
+		return c != '%' && validStringLiteralChar(c)
+	}))
+	assert.Error(t, err)
+}
+
+func TestWithFieldNameTransform(t *testing.T) {
+	log := `[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] [msg] [RegionID=A] ["Peer Id"=Bc]`
+	for _, opts := range [][]Option{
+		{WithFieldNameTransform(strings.ToLower)},
+		{WithFieldNameTransform(strings.ToLower), WithLineBuffer(true)},
+		{WithFieldNameTransform(strings.ToLower), WithStringInterning(true)},
+	} {
+		entries, err := ParseFromString(log, opts...)
+		assert.NoError(t, err)
+		assert.Len(t, entries, 1)
+		assert.Equal(t, []LogField{{Name: "regionid", Value: "A"}, {Name: "peer id", Value: "Bc"}}, entries[0].Fields)
+	}
+}
+
+func TestWithFlexibleTokenOrder(t *testing.T) {
+	log := `[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] ["Welcome"] [region_id=4] ["peer id"="a b"]
+[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] [region_id=4] ["peer id"="a b"] ["Welcome"]
+[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] [region_id=4] ["Welcome"] ["peer id"="a b"]
+[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] [region_id=4] ["x=y] \"z"] ["peer id"="a b"]`
+	for _, opts := range [][]Option{
+		{WithFlexibleTokenOrder(true)},
+		{WithFlexibleTokenOrder(true), WithLineBuffer(true)},
+	} {
+		entries, err := ParseFromString(log, opts...)
+		assert.NoError(t, err)
+		assert.Len(t, entries, 4)
+		for _, entry := range entries[:3] {
+			assert.True(t, entries[0].Equal(entry))
+			assert.Equal(t, "Welcome", entry.Message)
+			assert.True(t, entry.MessageQuoted)
+		}
+		assert.Equal(t, `x=y] "z`, entries[3].Message)
+		assert.Equal(t, entries[0].Fields, entries[3].Fields)
+	}
+	_, err := ParseFromString(log)
+	assert.Error(t, err)
+
+	// The message is required.
+	_, err = ParseFromString(`[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] [region_id=4]`, WithFlexibleTokenOrder(true))
+	assert.Error(t, err)
+
+	entries, err := ParseFromString(`[2021/08/04 12:00:43.128 +08:00] [INFO] [region:east] [Welcome] [k:v]`,
+		WithFlexibleTokenOrder(true), WithOptionalFileLine(true), WithFieldSeparator(':'))
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1)
+	assert.Equal(t, "", entries[0].Header.File)
+	assert.Equal(t, "Welcome", entries[0].Message)
+	assert.Equal(t, []LogField{{Name: "region", Value: "east"}, {Name: "k", Value: "v"}}, entries[0].Fields)
+}
+
+func TestWithBlankLineFunc(t *testing.T) {
+	entry := "[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] [msg]"
+	for _, c := range []struct {
+		log    string
+		counts []int
+		opts   []Option
+	}{
+		{entry + "\n" + entry, nil, nil},
+		{"\n\n" + entry + "  \n\n", []int{2, 1}, nil},
+		{entry + "\r\n\n\r\n" + entry + "\n\n\n" + entry + "\n", []int{2, 2}, nil},
+		{entry + "\r\n\n\r\n" + entry + "\n\n\n" + entry + "\n", []int{2, 2}, []Option{WithLineBuffer(true)}},
+		{entry + "\n\n  at main.go:12\n\n\n" + entry + "\n\n", []int{2, 1}, []Option{WithAttachContinuations(true)}},
+	} {
+		var counts []int
+		opts := append(c.opts, WithBlankLineFunc(func(count int) {
+			counts = append(counts, count)
+		}))
+		_, err := ParseFromString(c.log, opts...)
+		assert.NoError(t, err)
+		assert.Equal(t, c.counts, counts, c.log)
+	}
+}
+
+func TestWithControlCharPolicy(t *testing.T) {
+	log := "[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] [\"a\x00b\\tc\"] [k\x01=v\x00w] [j={\"x\":\"\x02\"}]"
+	for _, c := range []struct {
+		policy  ControlCharPolicy
+		message string
+		fields  []LogField
+	}{
+		{ControlCharStrip, "ab\tc", []LogField{{Name: "k", Value: "vw"}, {Name: "j", Value: `{"x":""}`}}},
+		{ControlCharReplace, "a b\tc", []LogField{{Name: "k ", Value: "v w"}, {Name: "j", Value: `{"x":" "}`}}},
+	} {
+		for _, opts := range [][]Option{
+			{WithControlCharPolicy(c.policy)},
+			{WithControlCharPolicy(c.policy), WithLineBuffer(true)},
+		} {
+			entries, err := ParseFromString(log, opts...)
+			assert.NoError(t, err)
+			assert.Len(t, entries, 1)
+			assert.Equal(t, c.message, entries[0].Message)
+			assert.Equal(t, c.fields, entries[0].Fields)
+		}
+	}
+
+	for _, log := range []string{
+		"[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] [\"a\x00b\"]",
+		"[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] [a\x00b]",
+		"[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] [msg] [k=v\x00]",
+	} {
+		for _, opts := range [][]Option{{}, {WithControlCharPolicy(ControlCharReject), WithLineBuffer(true)}} {
+			_, err := ParseFromString(log, opts...)
+			assert.Error(t, err)
+			assert.Contains(t, err.Error(), "unexpected control character U+0000")
+		}
+	}
+
+	entries, err := ParseFromString("[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] a\x00b [k=v]",
+		WithUnbracketedMessage(true), WithControlCharPolicy(ControlCharStrip))
+	assert.NoError(t, err)
+	assert.Equal(t, "ab", entries[0].Message)
+}
+
+func TestWithCommaFractionalSeconds(t *testing.T) {
+	log := `[2021/08/04 12:00:43,128 +08:00] [INFO] [lib.rs:81] [msg]
+[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] [msg]`
+	for _, opts := range [][]Option{
+		{WithCommaFractionalSeconds(true)},
+		{WithCommaFractionalSeconds(true), WithStrictDatetime(true)},
+	} {
+		entries, err := ParseFromString(log, opts...)
+		assert.NoError(t, err)
+		assert.Len(t, entries, 2)
+		assert.Equal(t, 128*int(time.Millisecond), entries[0].Header.DateTime.Nanosecond())
+		assert.True(t, entries[0].Equal(entries[1]))
+	}
+	_, err := ParseFromString(log)
+	assert.Error(t, err)
+	// Only the fractional separator may be a comma.
+	_, err = ParseFromString(`[2021/08/04 12:00,43.128 +08:00] [INFO] [lib.rs:81] [msg]`, WithCommaFractionalSeconds(true))
+	assert.Error(t, err)
+}
+
+func TestWithMaxLineLength(t *testing.T) {
+	entry := "[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] [msg] [k=v]"
+	log := entry + "\r\n" + entry + "\n  backtrace\n"
+	for _, opts := range [][]Option{
+		{WithMaxLineLength(len(entry)), WithAttachContinuations(true)},
+		{WithMaxLineLength(len(entry)), WithAttachContinuations(true), WithLineBuffer(true)},
+	} {
+		entries, err := ParseFromString(log, opts...)
+		assert.NoError(t, err)
+		assert.Len(t, entries, 2)
+	}
+	garbage := entry[:len(entry)-1] + strings.Repeat("x", 10000)
+	for _, c := range []struct {
+		log  string
+		opts []Option
+	}{
+		{log, []Option{WithMaxLineLength(len(entry) - 1)}},
+		{log, []Option{WithMaxLineLength(len(entry) - 1), WithLineBuffer(true)}},
+		{garbage, []Option{WithMaxLineLength(1000), WithLastFieldGreedy(true)}},
+		{garbage, []Option{WithMaxLineLength(1000), WithLineBuffer(true)}},
+		{entry + "\n" + strings.Repeat("x", 10000), []Option{WithMaxLineLength(1000), WithAttachContinuations(true)}},
+	} {
+		_, err := ParseFromString(c.log, c.opts...)
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "exceeds the maximum length of")
+	}
+	_, err := ParseFromString(entry+"\n"+garbage, WithMaxLineLength(1000))
+	assert.Contains(t, err.Error(), "line 2 exceeds the maximum length of 1000 bytes")
+}
+
+func TestWithLevelAliases(t *testing.T) {
+	log := `[2021/08/04 12:00:43.128 +08:00] [CRITICAL] [lib.rs:81] [msg]
+[2021/08/04 12:00:43.128 +08:00] [Notice] [lib.rs:81] [msg]
+[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] [msg]
+[2021/08/04 12:00:43.128 +08:00] [W] [lib.rs:81] [msg]`
+	aliases := map[string]LogLevel{
+		"CRITICAL": LogLevelFatal,
+		"notice":   LogLevelInfo,
+		"W":        LogLevelError,
+	}
+	for _, opts := range [][]Option{
+		{WithLevelAliases(aliases)},
+		{WithLevelAliases(aliases), WithLineBuffer(true)},
+	} {
+		entries, err := ParseFromString(log, opts...)
+		assert.NoError(t, err)
+		assert.Len(t, entries, 4)
+		assert.Equal(t, LogLevelFatal, entries[0].Header.Level)
+		assert.Equal(t, LogLevelInfo, entries[1].Header.Level)
+		assert.Equal(t, LogLevelInfo, entries[2].Header.Level)
+		assert.Equal(t, LogLevelError, entries[3].Header.Level)
+	}
+	_, err := ParseFromString(log)
+	assert.Error(t, err)
+
+	_, err = ParseFromString(`[2021/08/04 12:00:43.128 +08:00] [TRACE] [lib.rs:81] [msg]`, WithLevelAliases(map[string]LogLevel{"TRACE": LogLevel(-2)}))
+	assert.Error(t, err)
+	_, err = ParseFromString(`[2021/08/04 12:00:43.128 +08:00] [VERYVERYVERYLONGLEVEL] [lib.rs:81] [msg]`, WithLevelAliases(map[string]LogLevel{"VERYVERYVERYLONGLEVEL": LogLevelInfo}))
+	assert.Error(t, err)
+}
+
+func TestWithUnbracketedDatetime(t *testing.T) {
+	log := `2021/08/04 12:00:43.128 +08:00 [INFO] [lib.rs:81] [msg] [k=v]
+  backtrace
+2021/08/04 12:00:43.128 Z [WARN] [lib.rs:81] [msg]
+2021/08/04 12:00:43,128 +08:00 [ERROR] [lib.rs:81] [msg]`
+	for _, opts := range [][]Option{
+		{WithUnbracketedDatetime(true), WithAttachContinuations(true), WithCommaFractionalSeconds(true)},
+		{WithUnbracketedDatetime(true), WithAttachContinuations(true), WithCommaFractionalSeconds(true), WithLineBuffer(true)},
+	} {
+		entries, err := ParseFromString(log, opts...)
+		assert.NoError(t, err)
+		assert.Len(t, entries, 3)
+		assert.True(t, entries[0].Header.DateTime.Equal(time.Date(2021, 8, 4, 4, 0, 43, 128*1000*1000, time.UTC)))
+		assert.Equal(t, []string{"  backtrace"}, entries[0].Continuation)
+		assert.Equal(t, []LogField{{Name: "k", Value: "v"}}, entries[0].Fields)
+		assert.Equal(t, time.UTC, entries[1].Header.DateTime.Location())
+		assert.Equal(t, LogLevelError, entries[2].Header.Level)
+	}
+	_, err := ParseFromString(log)
+	assert.Error(t, err)
+
+	for _, log := range []string{
+		`[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] [msg]`,
+		`2021/08/04 12:00:43.128 +08:00`,
+		`2021/08/04 12:00:43.128 +08:00 INFO [lib.rs:81] [msg]`,
+	} {
+		_, err := ParseFromString(log, WithUnbracketedDatetime(true))
+		assert.Error(t, err, log)
+	}
+
+	// With WithFlexibleWhitespace, any run of spaces and tabs may follow.
+	log = "2021/08/04 12:00:43.128 +08:00\t[INFO] [lib.rs:81] [msg]\n" +
+		"2021/08/04 12:00:43.128 +08:00  [INFO] [lib.rs:81] [msg]\n" +
+		"2021/08/04 12:00:43.128 +08:00 \t [INFO] [lib.rs:81] [msg]"
+	for _, opts := range [][]Option{
+		{WithUnbracketedDatetime(true), WithFlexibleWhitespace(true)},
+		{WithUnbracketedDatetime(true), WithFlexibleWhitespace(true), WithLineBuffer(true)},
+	} {
+		entries, err := ParseFromString(log, opts...)
+		assert.NoError(t, err)
+		assert.Len(t, entries, 3)
+		for _, e := range entries {
+			assert.True(t, e.Header.DateTime.Equal(time.Date(2021, 8, 4, 4, 0, 43, 128*1000*1000, time.UTC)))
+			assert.Equal(t, LogLevelInfo, e.Header.Level)
+		}
+	}
+}
+
+func TestWithFlexibleWhitespace(t *testing.T) {
+	log := "[2021/08/04 12:00:43.128 +08:00]\t[INFO]   [lib.rs:81] \t [msg]\t[k=v]  \t[a=b]\t\n" +
+		"[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] [msg] [k=v] [a=b]"
+	for _, opts := range [][]Option{
+		{WithFlexibleWhitespace(true)},
+		{WithFlexibleWhitespace(true), WithLineBuffer(true)},
+	} {
+		entries, err := ParseFromString(log, opts...)
+		assert.NoError(t, err)
+		assert.Len(t, entries, 2)
+		assert.True(t, entries[0].Equal(entries[1]))
+		assert.Equal(t, []LogField{{Name: "k", Value: "v"}, {Name: "a", Value: "b"}}, entries[0].Fields)
+	}
+	for _, log := range []string{
+		"[2021/08/04 12:00:43.128 +08:00]\t[INFO] [lib.rs:81] [msg]",
+		"[2021/08/04 12:00:43.128 +08:00]  [INFO] [lib.rs:81] [msg]",
+		"[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] [msg]\t[k=v]",
+	} {
+		_, err := ParseFromString(log)
+		assert.Error(t, err, log)
+	}
+	_, err := ParseFromString("[2021/08/04 12:00:43.128 +08:00][INFO] [lib.rs:81] [msg]", WithFlexibleWhitespace(true))
+	assert.Error(t, err)
+}
+
+func TestWithPartialEntries(t *testing.T) {
+	first := "[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] [first]\n"
+	entry := `[2021/08/04 12:00:44.128 +08:00] [WARN] [lib.rs:82] ["Welcome"] [k=v] [k2=v2`
+	datetime := time.Date(2021, 8, 4, 12, 0, 44, 128000000, time.FixedZone("", 8*3600))
+	for _, c := range []struct {
+		truncated string
+		expect    LogEntry
+	}{
+		{"[2021/08/04 12:0", LogEntry{}},
+		{"[2021/08/04 12:00:44.128 +08:00] [WA", LogEntry{Header: LogHeader{DateTime: datetime}}},
+		{"[2021/08/04 12:00:44.128 +08:00] [WARN] [lib.r", LogEntry{Header: LogHeader{DateTime: datetime, Level: LogLevelWarn}}},
+		{`[2021/08/04 12:00:44.128 +08:00] [WARN] [lib.rs:82] ["Wel`, LogEntry{Header: LogHeader{DateTime: datetime, Level: LogLevelWarn, File: "lib.rs", Line: 82}}},
+		{entry, LogEntry{
+			Header:        LogHeader{DateTime: datetime, Level: LogLevelWarn, File: "lib.rs", Line: 82},
+			Message:       "Welcome",
+			MessageQuoted: true,
+			Fields:        []LogField{{Name: "k", Value: "v"}},
+		}},
+	} {
+		for _, opt := range []Option{WithLineBuffer(false), WithLineBuffer(true)} {
+			entries, err := ParseFromString(first+c.truncated, WithPartialEntries(true), opt)
+			assert.NoError(t, err, c.truncated)
+			if assert.Len(t, entries, 2, c.truncated) {
+				assert.False(t, entries[0].Partial)
+				assert.True(t, entries[1].Partial)
+				entries[1].Partial = false
+				assert.True(t, c.expect.Header.DateTime.Equal(entries[1].Header.DateTime), c.truncated)
+				assert.True(t, c.expect.Equal(entries[1]), c.truncated)
+			}
+
+			p := NewStreamParser(strings.NewReader(c.truncated), WithPartialEntries(true), opt)
+			var e LogEntry
+			ok, err := p.ParseInto(&e)
+			assert.NoError(t, err)
+			assert.True(t, ok)
+			assert.True(t, e.Partial)
+			ok, err = p.ParseInto(&e)
+			assert.NoError(t, err)
+			assert.False(t, ok)
+		}
+	}
+
+	// A complete entry is not partial, and other errors are kept.
+	entries, err := ParseFromString(first, WithPartialEntries(true))
+	assert.NoError(t, err)
+	assert.False(t, entries[0].Partial)
+	_, err = ParseFromString(first+"[2021/08/04 12:00:43.128 +08:00] [BAD] [lib.rs:81] [msg]", WithPartialEntries(true))
+	assert.Error(t, err)
+}
+
+func TestWithTrailingTokenPolicy(t *testing.T) {
+	log := "[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] [msg] [k=v] (retried 2x)  \n" +
+		"[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] [msg]   \n" +
+		"[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] [msg] [k=v]x\r\n" +
+		"  backtrace\n" +
+		"[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] [msg] tail"
+	for _, lineBuffer := range []bool{false, true} {
+		for _, attach := range []bool{false, true} {
+			opts := []Option{WithLineBuffer(lineBuffer), WithAttachContinuations(attach)}
+			_, err := ParseFromString(log, opts...)
+			assert.Error(t, err)
+			assert.Contains(t, err.Error(), "unexpected character '('")
+			var perr *ParseError
+			if assert.True(t, errors.As(err, &perr)) {
+				assert.Equal(t, 1, perr.Line)
+				assert.Equal(t, StageField, perr.Stage)
+			}
+
+			l := log
+			if !attach {
+				l = strings.Replace(log, "  backtrace\n", "", 1)
+			}
+			for _, policy := range []TrailingTokenPolicy{TrailingTokenIgnore, TrailingTokenCapture} {
+				entries, err := ParseFromString(l, append(opts, WithTrailingTokenPolicy(policy))...)
+				assert.NoError(t, err)
+				if !assert.Len(t, entries, 4) {
+					continue
+				}
+				expect := []string{"(retried 2x)", "", "x", "tail"}
+				for i, e := range entries {
+					if policy == TrailingTokenIgnore {
+						assert.Equal(t, "", e.Trailer)
+					} else {
+						assert.Equal(t, expect[i], e.Trailer)
+					}
+					assert.Equal(t, "msg", e.Message)
+				}
+				assert.Equal(t, []LogField{{Name: "k", Value: "v"}}, entries[2].Fields)
+				if attach {
+					assert.Equal(t, []string{"  backtrace"}, entries[2].Continuation)
+				}
+			}
+		}
+	}
+
+	// A comment takes precedence.
+	entries, err := ParseFromString(`[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] [msg] // note`,
+		WithTrailingComment("//"), WithTrailingTokenPolicy(TrailingTokenCapture))
+	assert.NoError(t, err)
+	assert.Equal(t, "note", entries[0].Comment)
+	assert.Equal(t, "", entries[0].Trailer)
+}
@@ -0,0 +1,37 @@
+package logparser
+
+import (
+	"io"
+	"sync"
+)
+
+// ParserPool caches StreamParsers so that their internal buffers can be
+// reused across many small inputs, e.g. when parsing log blobs in a server.
+//
+// A ParserPool is safe for concurrent use by multiple goroutines, but each
+// StreamParser obtained from Get must only be used by one goroutine at a time.
+// The zero value is ready to use and creates parsers without options.
+type ParserPool struct {
+	pool sync.Pool
+	opts []Option
+}
+
+// NewParserPool creates a *ParserPool whose parsers are configured with opts.
+func NewParserPool(opts ...Option) *ParserPool {
+	return &ParserPool{opts: opts}
+}
+
+// Get returns a *StreamParser reading from r, reusing a cached one if any.
+func (pp *ParserPool) Get(r io.Reader) *StreamParser {
+	if p, ok := pp.pool.Get().(*StreamParser); ok {
+		p.Reset(r)
+		return p
+	}
+	return NewStreamParser(r, pp.opts...)
+}
+
+// Put returns p to the pool. p must not be used after calling Put.
+func (pp *ParserPool) Put(p *StreamParser) {
+	p.Reset(nil)
+	pp.pool.Put(p)
+}
@@ -0,0 +1,84 @@
+package logparser
+
+import (
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParserPool(t *testing.T) {
+	pool := NewParserPool(WithMaxFields(1))
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				p := pool.Get(strings.NewReader("[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] [\"Welcome to TiKV\"] [k=v]\n\n"))
+				entry, err := p.ParseNext()
+				assert.NoError(t, err)
+				assert.Equal(t, "Welcome to TiKV", entry.Message)
+				entry, err = p.ParseNext()
+				assert.NoError(t, err)
+				assert.Nil(t, entry)
+				assert.Equal(t, 3, p.line)
+				pool.Put(p)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Options are kept by reused parsers.
+	p := pool.Get(strings.NewReader("[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] [msg] [k1=v1] [k2=v2]"))
+	_, err := p.ParseNext()
+	assert.Error(t, err)
+	pool.Put(p)
+
+	var zero ParserPool
+	p = zero.Get(strings.NewReader("[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] [msg]"))
+	entry, err := p.ParseNext()
+	assert.NoError(t, err)
+	assert.Equal(t, "msg", entry.Message)
+	zero.Put(p)
+}
+
+func TestStreamParser_Reset(t *testing.T) {
+	parser := NewStreamParser(strings.NewReader("\n\n[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] [first] [k=v]"))
+	entry, err := parser.ParseNext()
+	assert.NoError(t, err)
+	assert.Equal(t, "first", entry.Message)
+	assert.Equal(t, 3, parser.line)
+	parser.Reset(strings.NewReader("[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] [second]"))
+	assert.Equal(t, 1, parser.line)
+	entry, err = parser.ParseNext()
+	assert.NoError(t, err)
+	assert.Equal(t, "second", entry.Message)
+}
+
+func TestParserPool_reuseAfterError(t *testing.T) {
+	pool := NewParserPool(WithLineBuffer(true))
+	p := pool.Get(strings.NewReader("[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] [msg] [k=v] x\r\n"))
+	_, err := p.ParseNext()
+	assert.Error(t, err)
+	pool.Put(p)
+
+	// The state of the failed stream is not passed on.
+	fresh := NewStreamParser(strings.NewReader("[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] [msg]\n"), WithLineBuffer(true))
+	expect, err := fresh.ParseNext()
+	assert.NoError(t, err)
+	p = pool.Get(strings.NewReader("[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] [msg]\n"))
+	entry, err := p.ParseNext()
+	assert.NoError(t, err)
+	assert.True(t, expect.Equal(entry))
+	_, err = fresh.ParseNext()
+	assert.NoError(t, err)
+	_, err = p.ParseNext()
+	assert.NoError(t, err)
+	assert.Equal(t, fresh.LineEnding(), p.LineEnding())
+	assert.Equal(t, "\n", p.LineEnding())
+	assert.Equal(t, fresh.literalQuoted, p.literalQuoted)
+	assert.False(t, p.captureRaw)
+	pool.Put(p)
+}
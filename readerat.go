@@ -0,0 +1,43 @@
+package logparser
+
+import (
+	"fmt"
+	"io"
+	"math"
+)
+
+// ParseEntryAt parses the single log entry which starts at offset in r, e.g.
+// an mmap'd log file. The offset must be at the beginning of a line which
+// starts an entry, otherwise an error matching ErrNotEntryStart is returned.
+// The entry is read through a buffer, so up to the buffer size past its
+// end may be read as well, see WithBufferSize.
+func ParseEntryAt(r io.ReaderAt, offset int64, opts ...Option) (*LogEntry, error) {
+	if offset < 0 {
+		return nil, fmt.Errorf("offset %d: %w", offset, ErrNotEntryStart)
+	}
+	if offset > 0 {
+		var b [1]byte
+		if _, err := r.ReadAt(b[:], offset-1); err != nil {
+			return nil, fmt.Errorf("offset %d: %w", offset, err)
+		}
+		if b[0] != '\n' {
+			return nil, fmt.Errorf("offset %d: %w", offset, ErrNotEntryStart)
+		}
+	}
+	p := NewStreamParser(io.NewSectionReader(r, offset, math.MaxInt64-offset), opts...)
+	start, err := p.isEntryStart()
+	if err != nil {
+		return nil, err
+	}
+	if !start {
+		return nil, fmt.Errorf("offset %d: %w", offset, ErrNotEntryStart)
+	}
+	entry, err := p.ParseNext()
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		return nil, fmt.Errorf("offset %d: %w", offset, ErrNotEntryStart)
+	}
+	return entry, nil
+}
@@ -0,0 +1,39 @@
+package logparser
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseEntryAt(t *testing.T) {
+	lines := []string{
+		"[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] [first] [i=0]",
+		"[2021/08/04 12:00:44.128 +08:00] [WARN] [lib.rs:82] [second] [i=1]",
+		"  backtrace",
+		"[2021/08/04 12:00:45.128 +08:00] [ERROR] [lib.rs:83] [third] [i=2]",
+	}
+	log := strings.Join(lines, "\n")
+	r := strings.NewReader(log)
+	all, err := ParseFromString(log, WithAttachContinuations(true))
+	assert.NoError(t, err)
+
+	offsets := []int64{0, int64(len(lines[0]) + 1), int64(len(lines[0]) + len(lines[1]) + len(lines[2]) + 3)}
+	for i, offset := range offsets {
+		entry, err := ParseEntryAt(r, offset, WithAttachContinuations(true))
+		assert.NoError(t, err)
+		assert.Equal(t, all[i], entry)
+	}
+
+	// Not at the beginning of a line, or not at an entry.
+	for _, offset := range []int64{-1, 1, offsets[1] - 1, offsets[2] - int64(len(lines[2])) - 1, int64(len(log))} {
+		_, err := ParseEntryAt(r, offset)
+		assert.True(t, errors.Is(err, ErrNotEntryStart), "offset=%d err=%v", offset, err)
+	}
+	_, err = ParseEntryAt(strings.NewReader(log+"\n"), int64(len(log)+1))
+	assert.True(t, errors.Is(err, ErrNotEntryStart))
+	_, err = ParseEntryAt(r, int64(len(log))+10)
+	assert.Error(t, err)
+}
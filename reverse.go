@@ -0,0 +1,84 @@
+package logparser
+
+import (
+	"bytes"
+	"io"
+)
+
+// reverseBlockSize is the size of the blocks ParseReverse reads backward.
+var reverseBlockSize = 64 << 10
+
+// ParseReverse parses the last n entries of rs, which are returned in order.
+// Instead of parsing the whole stream, rs is read backward in blocks to find
+// where the last n entries start, that is the last n lines beginning with
+// '[' and a digit after optional spaces, and only the entries from there on
+// are parsed. With WithLinePrefix or WithUnbracketedDatetime, the lines are
+// matched like by the parser. If there are fewer than n entries, all of
+// them are returned.
+//
+// Lines which do not start an entry, like a backtrace, are only accepted
+// with WithAttachContinuations, as in ParseFromReader.
+func ParseReverse(rs io.ReadSeeker, n int, opts ...Option) ([]*LogEntry, error) {
+	if n <= 0 {
+		return nil, nil
+	}
+	start, err := findLastEntries(rs, n, NewStreamParser(nil, opts...).lineStartsEntry)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := rs.Seek(start, io.SeekStart); err != nil {
+		return nil, err
+	}
+	entries, err := ParseFromReader(rs, opts...)
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) > n {
+		entries = entries[len(entries)-n:]
+	}
+	return entries, nil
+}
+
+// findLastEntries returns the offset of the n-th last line of rs for which
+// isStart reports the start of an entry, or 0 if there are fewer such lines.
+func findLastEntries(rs io.ReadSeeker, n int, isStart func(line []byte) bool) (int64, error) {
+	pos, err := rs.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, err
+	}
+	// carry is the beginning of the earliest line read so far, which may
+	// start in a block not read yet.
+	var carry []byte
+	found := 0
+	for pos > 0 {
+		size := int64(reverseBlockSize)
+		if size > pos {
+			size = pos
+		}
+		pos -= size
+		buf := make([]byte, int(size)+len(carry))
+		if _, err := rs.Seek(pos, io.SeekStart); err != nil {
+			return 0, err
+		}
+		if _, err := io.ReadFull(rs, buf[:size]); err != nil {
+			return 0, err
+		}
+		copy(buf[size:], carry)
+		end := len(buf)
+		for {
+			i := bytes.LastIndexByte(buf[:end], '\n')
+			if i < 0 {
+				break
+			}
+			if isStart(buf[i+1 : end]) {
+				found++
+				if found == n {
+					return pos + int64(i+1), nil
+				}
+			}
+			end = i
+		}
+		carry = buf[:end]
+	}
+	return 0, nil
+}
@@ -0,0 +1,83 @@
+package logparser
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseReverse(t *testing.T) {
+	var b strings.Builder
+	for i := 0; i < 20; i++ {
+		fmt.Fprintf(&b, "[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] [msg%d] [i=%d]\n", i, i)
+		if i%4 == 0 {
+			b.WriteString("  backtrace\n\n")
+		}
+	}
+	log := b.String()
+	all, err := ParseFromString(log, WithAttachContinuations(true))
+	assert.NoError(t, err)
+
+	defer func(size int) { reverseBlockSize = size }(reverseBlockSize)
+	for _, size := range []int{7, 64, 1 << 16} {
+		reverseBlockSize = size
+		for _, n := range []int{1, 2, 5, 19, 20, 30} {
+			entries, err := ParseReverse(strings.NewReader(log), n, WithAttachContinuations(true))
+			assert.NoError(t, err)
+			expect := all
+			if n < len(all) {
+				expect = all[len(all)-n:]
+			}
+			assert.Equal(t, expect, entries, "size=%d n=%d", size, n)
+		}
+	}
+
+	entries, err := ParseReverse(strings.NewReader(log), 0)
+	assert.NoError(t, err)
+	assert.Empty(t, entries)
+	entries, err = ParseReverse(strings.NewReader(""), 3)
+	assert.NoError(t, err)
+	assert.Empty(t, entries)
+
+	// The beginning of the file is not parsed.
+	entries, err = ParseReverse(strings.NewReader("garbage\n"+log), 3, WithAttachContinuations(true))
+	assert.NoError(t, err)
+	assert.Equal(t, all[len(all)-3:], entries)
+	_, err = ParseReverse(strings.NewReader("garbage\n"+log), 30, WithAttachContinuations(true))
+	assert.Error(t, err)
+}
+
+func TestParseReverse_entryStart(t *testing.T) {
+	// Entry starts are found like by the parser, so the garbage at the
+	// beginning is not parsed.
+	for _, c := range []struct {
+		log  string
+		opts []Option
+	}{
+		{
+			"host01 tikv: [2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] [first]\n" +
+				"host02 tikv: [2021/08/04 12:00:43.129 +08:00] [INFO] [lib.rs:81] [second]\n",
+			[]Option{WithLinePrefix(regexp.MustCompile(`^\S+ \S+: `))},
+		},
+		{
+			"2021/08/04 12:00:43.128 +08:00 [INFO] [lib.rs:81] [first]\n" +
+				"2021/08/04 12:00:43.129 +08:00 [INFO] [lib.rs:81] [second]\n",
+			[]Option{WithUnbracketedDatetime(true)},
+		},
+	} {
+		entries, err := ParseReverse(strings.NewReader("garbage\n"+c.log), 2, c.opts...)
+		assert.NoError(t, err)
+		if assert.Len(t, entries, 2) {
+			assert.Equal(t, "first", entries[0].Message)
+			assert.Equal(t, "second", entries[1].Message)
+		}
+		entries, err = ParseReverse(strings.NewReader("garbage\n"+c.log), 1, c.opts...)
+		assert.NoError(t, err)
+		if assert.Len(t, entries, 1) {
+			assert.Equal(t, "second", entries[0].Message)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package logparser
+
+import (
+	"io"
+	"strings"
+)
+
+// SlowLogEntry is one entry of a slow-query log. It has the same header as
+// a regular log entry, followed by lines like `# Query_time: 1.5` and the
+// query itself.
+type SlowLogEntry struct {
+	Header  LogHeader
+	Message string
+	Fields  []LogField
+	// Attributes are the `# Key: value` lines after the header, in order.
+	Attributes []LogField `json:",omitempty"`
+	// Body is the other lines after the header, e.g. the query.
+	Body []string `json:",omitempty"`
+}
+
+// Attribute returns the value of the first attribute with the given key,
+// and whether it exists.
+func (e *SlowLogEntry) Attribute(key string) (string, bool) {
+	for _, a := range e.Attributes {
+		if a.Name == key {
+			return a.Value, true
+		}
+	}
+	return "", false
+}
+
+// ParseSlowLog parses a slow-query log from io.Reader. The header of each
+// entry is parsed like a regular log entry, and the lines up to the next
+// entry are split into attributes and body, see SlowLogEntry. A line
+// starting with "# " is an attribute if it has a ": " separating the key
+// from the value. Empty lines are skipped. The lines of an entry are
+// attached as by WithAttachContinuations, which is implied.
+func ParseSlowLog(r io.Reader, opts ...Option) ([]*SlowLogEntry, error) {
+	opts = append(opts[:len(opts):len(opts)], WithAttachContinuations(true))
+	p := NewStreamParser(r, opts...)
+	var entries []*SlowLogEntry
+	for {
+		entry, err := p.ParseNext()
+		if err != nil {
+			return nil, err
+		}
+		if entry == nil {
+			break
+		}
+		e := &SlowLogEntry{
+			Header:  entry.Header,
+			Message: entry.Message,
+			Fields:  entry.Fields,
+		}
+		for _, line := range entry.Continuation {
+			if key, value, ok := parseSlowLogAttribute(line); ok {
+				e.Attributes = append(e.Attributes, LogField{Name: key, Value: value})
+			} else {
+				e.Body = append(e.Body, line)
+			}
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// parseSlowLogAttribute splits a line like `# Query_time: 1.5` into its key
+// and value.
+func parseSlowLogAttribute(line string) (string, string, bool) {
+	line = strings.TrimLeft(line, " ")
+	if !strings.HasPrefix(line, "# ") {
+		return "", "", false
+	}
+	line = strings.TrimLeft(line[2:], " ")
+	i := strings.Index(line, ": ")
+	if i <= 0 {
+		return "", "", false
+	}
+	return line[:i], strings.TrimSpace(line[i+2:]), true
+}
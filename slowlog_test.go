@@ -0,0 +1,52 @@
+package logparser
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSlowLog(t *testing.T) {
+	log := `[2021/08/04 12:00:43.128 +08:00] [WARN] [tracker.rs:146] ["slow query"] [region_id=4]
+# Time: 2021-08-04T12:00:43.128+08:00
+# Query_time: 1.52
+# Process_time: 1.5 Wait_time: 0.02
+#comment
+# Digest:
+select * from t where a = 1;
+
+[2021/08/04 12:00:44.128 +08:00] [WARN] [tracker.rs:146] ["slow query"]
+# Query_time: 0.8
+[2021/08/04 12:00:45.128 +08:00] [WARN] [tracker.rs:146] ["slow query"]
+`
+	entries, err := ParseSlowLog(strings.NewReader(log))
+	assert.NoError(t, err)
+	assert.Len(t, entries, 3)
+
+	e := entries[0]
+	assert.Equal(t, LogLevelWarn, e.Header.Level)
+	assert.Equal(t, "tracker.rs", e.Header.File)
+	assert.Equal(t, "slow query", e.Message)
+	assert.Equal(t, []LogField{{Name: "region_id", Value: "4"}}, e.Fields)
+	assert.Equal(t, []LogField{
+		{Name: "Time", Value: "2021-08-04T12:00:43.128+08:00"},
+		{Name: "Query_time", Value: "1.52"},
+		{Name: "Process_time", Value: "1.5 Wait_time: 0.02"},
+	}, e.Attributes)
+	assert.Equal(t, []string{"#comment", "# Digest:", "select * from t where a = 1;"}, e.Body)
+	v, ok := e.Attribute("Query_time")
+	assert.True(t, ok)
+	assert.Equal(t, "1.52", v)
+	_, ok = e.Attribute("Digest")
+	assert.False(t, ok)
+
+	v, ok = entries[1].Attribute("Query_time")
+	assert.True(t, ok)
+	assert.Equal(t, "0.8", v)
+	assert.Empty(t, entries[1].Body)
+	assert.Empty(t, entries[2].Attributes)
+
+	_, err = ParseSlowLog(strings.NewReader(`[2021/08/04 12:00:44.128 +08:00] [WARN] [tracker.rs:x] ["slow query"]`))
+	assert.Error(t, err)
+}
@@ -0,0 +1,44 @@
+package logparser
+
+import "io"
+
+// Stats summarizes a log, see ParseStats.
+type Stats struct {
+	// Entries is the number of entries.
+	Entries int
+	// FieldNameCounts maps each field name to the number of its
+	// occurrences.
+	FieldNameCounts map[string]int
+	// TotalFieldBytes is the total length of the names and values of all
+	// fields in bytes, after unquoting.
+	TotalFieldBytes int64
+}
+
+// ParseStats parses the whole stream and returns its Stats. The entries are
+// not retained, so the memory usage only depends on the number of distinct
+// field names.
+func ParseStats(r io.Reader, opts ...Option) (*Stats, error) {
+	stats := &Stats{FieldNameCounts: make(map[string]int)}
+	p := NewStreamParser(r, opts...)
+	var e LogEntry
+	for {
+		ok, err := p.ParseInto(&e)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			break
+		}
+		stats.Entries++
+		for _, f := range e.Fields {
+			if _, ok := stats.FieldNameCounts[f.Name]; !ok {
+				// Do not retain the line the name may be sliced from, see
+				// WithLineBuffer.
+				f.Name = string([]byte(f.Name))
+			}
+			stats.FieldNameCounts[f.Name]++
+			stats.TotalFieldBytes += int64(len(f.Name) + len(f.Value))
+		}
+	}
+	return stats, nil
+}
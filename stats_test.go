@@ -0,0 +1,29 @@
+package logparser
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseStats(t *testing.T) {
+	log := `[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] [msg] [region_id=4] [peer="a b"]
+[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] [msg]
+[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:81] [msg] [region_id=12]`
+	stats, err := ParseStats(strings.NewReader(log))
+	assert.NoError(t, err)
+	assert.Equal(t, &Stats{
+		Entries:         3,
+		FieldNameCounts: map[string]int{"region_id": 2, "peer": 1},
+		TotalFieldBytes: 10 + 7 + 11,
+	}, stats)
+
+	stats, err = ParseStats(strings.NewReader(""))
+	assert.NoError(t, err)
+	assert.Equal(t, 0, stats.Entries)
+	assert.Empty(t, stats.FieldNameCounts)
+
+	_, err = ParseStats(strings.NewReader(log + "\n[2021/08/04 12:00:43.128 +08:00] [INFO] [lib.rs:x] [msg]"))
+	assert.Error(t, err)
+}
@@ -0,0 +1,371 @@
+package logparser
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// TokenKind is the kind of a Token.
+type TokenKind int
+
+const (
+	// TokenEOF means there is nothing left. It is the zero value.
+	TokenEOF TokenKind = iota
+	// TokenDatetime is the datetime at the beginning of an entry.
+	TokenDatetime
+	// TokenLevel is the log level.
+	TokenLevel
+	// TokenFileLine is the source file and line.
+	TokenFileLine
+	// TokenMessage is the message.
+	TokenMessage
+	// TokenField is one k/v field.
+	TokenField
+	// TokenContinuation is one continuation line, see WithAttachContinuations.
+	TokenContinuation
+	// TokenEndOfEntry marks the end of an entry.
+	TokenEndOfEntry
+	// TokenSource is the line prefix before the datetime, see
+	// WithLinePrefix. It is the first token of an entry, if present.
+	TokenSource
+	// TokenComment is the trailing comment after the fields, see
+	// WithTrailingComment.
+	TokenComment
+	// TokenTrailer is the unexpected text after the fields, see
+	// TrailingTokenCapture.
+	TokenTrailer
+)
+
+func (k TokenKind) String() string {
+	switch k {
+	case TokenEOF:
+		return "EOF"
+	case TokenDatetime:
+		return "Datetime"
+	case TokenLevel:
+		return "Level"
+	case TokenFileLine:
+		return "FileLine"
+	case TokenMessage:
+		return "Message"
+	case TokenField:
+		return "Field"
+	case TokenContinuation:
+		return "Continuation"
+	case TokenEndOfEntry:
+		return "EndOfEntry"
+	case TokenSource:
+		return "Source"
+	case TokenComment:
+		return "Comment"
+	case TokenTrailer:
+		return "Trailer"
+	default:
+		return fmt.Sprintf("TokenKind(%d)", int(k))
+	}
+}
+
+// Token is one bracketed group of a log entry, like `[INFO]` or `[k=v]`.
+// Only the value fields corresponding to Kind are set.
+type Token struct {
+	Kind TokenKind
+	// Raw is the raw text of the token, including the brackets. It is only
+	// set by NextToken.
+	Raw string
+
+	DateTime time.Time // TokenDatetime
+	Level    LogLevel  // TokenLevel
+	File     string    // TokenFileLine
+	Line     int       // TokenFileLine
+	Text     string    // TokenMessage, TokenContinuation, TokenSource, TokenComment, TokenTrailer
+	Quoted   bool      // TokenMessage
+	Field    LogField  // TokenField
+	// OriginalOffset is the zone offset of DateTime in seconds, if it is
+	// normalized to UTC by WithNormalizeUTC.
+	OriginalOffset int // TokenDatetime
+}
+
+// scanState is the position of the tokenizer inside of an entry.
+type scanState int
+
+const (
+	stateEntryStart scanState = iota
+	stateDatetime
+	stateLevel
+	stateFileLine
+	stateMessage
+	stateFields
+	stateEntryEnd
+	stateContinuationStart
+	stateContinuation
+)
+
+// NextToken reads and returns the next token of the stream. A log entry is
+// a TokenDatetime, TokenLevel, TokenFileLine and TokenMessage, followed by
+// any number of TokenField, an optional TokenComment or TokenTrailer, any
+// number of TokenContinuation, and then TokenEndOfEntry.
+// A token with kind TokenEOF is returned at the end of the stream. With
+// WithLinePrefix, an entry may start with a TokenSource. With
+// WithFlexibleTokenOrder, TokenField may precede TokenMessage as well.
+//
+// NextToken and ParseNext can be mixed, as long as ParseNext is only called
+// between entries.
+func (p *StreamParser) NextToken() (Token, error) {
+	if p.concurrencyCheck {
+		p.enter()
+		defer p.leave()
+	}
+	var tok Token
+	p.captureRaw = true
+	p.rawBuf = p.rawBuf[:0]
+	err := p.scanToken(&tok)
+	p.captureRaw = false
+	switch tok.Kind {
+	case TokenEOF, TokenEndOfEntry:
+	case TokenContinuation:
+		tok.Raw = tok.Text
+	default:
+		tok.Raw = string(p.rawBuf)
+	}
+	return tok, err
+}
+
+// scanToken reads the next token into tok. On failure, the tokenizer starts
+// over from a new entry.
+func (p *StreamParser) scanToken(tok *Token) error {
+	stage, err := p.scan(tok)
+	if err != nil {
+		if p.inEntry && (errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)) {
+			err = &incompleteEntryError{err: err}
+		}
+		p.unloadLine()
+		p.state = stateEntryStart
+		p.inEntry = false
+		return p.wrapErr(stage, err)
+	}
+	return nil
+}
+
+func (p *StreamParser) scan(tok *Token) (string, error) {
+	var err error
+	switch p.state {
+	case stateEntryStart:
+		p.lastStage = ""
+		p.fieldCount = 0
+		if !p.bomChecked {
+			p.bomChecked = true
+			if err := p.skipBOM(); err != nil {
+				return StageDatetime, err
+			}
+		}
+		// Skip empty lines.
+		err := p.trimNewLines()
+		if err == nil || err == io.EOF {
+			p.reportBlankLines()
+		}
+		if err != nil {
+			if err == io.EOF {
+				tok.Kind = TokenEOF
+				return "", nil
+			}
+			return StageDatetime, err
+		}
+		if p.lineBuffer {
+			if err := p.loadLine(); err != nil {
+				return StageDatetime, err
+			}
+		}
+		if p.linePrefix != nil {
+			if err := p.trimChar(' '); err != nil {
+				return StageDatetime, err
+			}
+			p.beginRaw()
+			source, ok, err := p.parseLinePrefix()
+			if err != nil {
+				return StageDatetime, err
+			}
+			if ok {
+				p.inEntry = true
+				p.state = stateDatetime
+				tok.Kind = TokenSource
+				tok.Text = source
+				break
+			}
+		}
+		return p.scanDatetime(tok)
+	case stateDatetime:
+		return p.scanDatetime(tok)
+	case stateLevel:
+		if err := p.skipSeparator(); err != nil {
+			return StageLevel, err
+		}
+		p.beginRaw()
+		tok.Kind = TokenLevel
+		if tok.Level, err = p.parseLogLevel(); err != nil {
+			return StageLevel, err
+		}
+		p.entryLevel = tok.Level
+		p.state = stateFileLine
+		p.lastStage = StageLevel
+	case stateFileLine:
+		if err := p.skipSeparator(); err != nil {
+			return StageFileLine, err
+		}
+		if p.optionalFileLine && !p.hasFileLine() {
+			// There is no file:line, the message follows the level directly.
+			p.lastStage = StageFileLine
+			return p.scanMessage(tok)
+		}
+		p.beginRaw()
+		tok.Kind = TokenFileLine
+		if tok.File, tok.Line, err = p.parseFileLine(); err != nil {
+			return StageFileLine, err
+		}
+		p.state = stateMessage
+		p.lastStage = StageFileLine
+	case stateMessage:
+		if err := p.skipSeparator(); err != nil {
+			return StageMessage, err
+		}
+		return p.scanMessage(tok)
+	case stateFields:
+		ok, err := p.nextField()
+		if err != nil {
+			return StageField, err
+		}
+		if ok {
+			tok.Kind = TokenField
+			if tok.Field, err = p.parseField(); err != nil {
+				return StageField, err
+			}
+			p.fieldCount++
+			break
+		}
+		// Skip spaces at the end of the line.
+		if err := p.trimSpaces(); err != nil && err != io.EOF {
+			return StageField, err
+		}
+		if p.commentPrefix != "" {
+			p.beginRaw()
+			comment, ok, err := p.parseComment()
+			if err != nil {
+				return StageField, err
+			}
+			if ok {
+				p.state = stateEntryEnd
+				tok.Kind = TokenComment
+				tok.Text = comment
+				break
+			}
+		}
+		p.beginRaw()
+		trailer, ok, err := p.parseTrailer()
+		if err != nil {
+			return StageField, err
+		}
+		if ok {
+			p.state = stateEntryEnd
+			tok.Kind = TokenTrailer
+			tok.Text = trailer
+			break
+		}
+		return p.scanEntryEnd(tok)
+	case stateEntryEnd:
+		return p.scanEntryEnd(tok)
+	case stateContinuationStart, stateContinuation:
+		line, ok, err := p.parseContinuation(p.state == stateContinuationStart)
+		if err != nil {
+			return StageContinuation, err
+		}
+		p.lastStage = StageContinuation
+		if !ok {
+			p.state = stateEntryStart
+			tok.Kind = TokenEndOfEntry
+			break
+		}
+		p.state = stateContinuation
+		tok.Kind = TokenContinuation
+		tok.Text = line
+	}
+	return "", nil
+}
+
+// scanDatetime reads the datetime token, after the optional line prefix.
+func (p *StreamParser) scanDatetime(tok *Token) (string, error) {
+	var err error
+	// Skip spaces at the beginning of the line.
+	if err := p.trimChar(' '); err != nil {
+		return StageDatetime, err
+	}
+	p.inEntry = true
+	p.beginRaw()
+	tok.Kind = TokenDatetime
+	if tok.DateTime, err = p.parseDatetime(); err != nil {
+		return StageDatetime, err
+	}
+	tok.OriginalOffset = 0
+	if p.normalizeUTC {
+		_, tok.OriginalOffset = tok.DateTime.Zone()
+		tok.DateTime = tok.DateTime.UTC()
+	}
+	p.state = stateLevel
+	p.lastStage = StageDatetime
+	return "", nil
+}
+
+// scanEntryEnd finishes the entry line after the fields, or the comment.
+func (p *StreamParser) scanEntryEnd(tok *Token) (string, error) {
+	// In line buffer mode, the rest of the line would be lost.
+	if p.lineLoaded {
+		if c, _, err := p.readRune(); err == nil {
+			return StageField, fmt.Errorf("unexpected character '%c'", c)
+		}
+		p.unloadLine()
+	}
+	p.lastStage = StageField
+	p.inEntry = false
+	p.levelCounts[p.entryLevel-LogLevelDebug]++
+	if !p.attachContinuations {
+		p.state = stateEntryStart
+		tok.Kind = TokenEndOfEntry
+		return "", nil
+	}
+	p.state = stateContinuationStart
+	return p.scan(tok)
+}
+
+// scanMessage reads the message token, after the space before it. With
+// WithFlexibleTokenOrder, it reads the fields before the message first.
+func (p *StreamParser) scanMessage(tok *Token) (string, error) {
+	var err error
+	if p.flexibleTokenOrder && p.peekField() {
+		ok, err := p.nextField()
+		if err != nil || !ok {
+			return StageField, err
+		}
+		tok.Kind = TokenField
+		if tok.Field, err = p.parseField(); err != nil {
+			return StageField, err
+		}
+		p.fieldCount++
+		p.state = stateMessage
+		p.lastStage = StageField
+		return "", nil
+	}
+	p.beginRaw()
+	tok.Kind = TokenMessage
+	if tok.Text, err = p.parseMessage(); err != nil {
+		return StageMessage, err
+	}
+	tok.Quoted = p.literalQuoted
+	p.state = stateFields
+	p.lastStage = StageMessage
+	return "", nil
+}
+
+// beginRaw starts recording the raw text of a token.
+func (p *StreamParser) beginRaw() {
+	p.rawBuf = p.rawBuf[:0]
+}
@@ -0,0 +1,107 @@
+package logparser
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStreamParser_NextToken(t *testing.T) {
+	parser := NewStreamParser(strings.NewReader(`[2021/09/23 14:25:14.123 +08:00] [INFO] [main.go:10] [msg] [k=v] ["a b"="c"]`))
+	var kinds []TokenKind
+	var raws []string
+	for {
+		tok, err := parser.NextToken()
+		assert.NoError(t, err)
+		kinds = append(kinds, tok.Kind)
+		raws = append(raws, tok.Raw)
+		if tok.Kind == TokenEOF {
+			break
+		}
+	}
+	assert.Equal(t, []TokenKind{
+		TokenDatetime, TokenLevel, TokenFileLine, TokenMessage,
+		TokenField, TokenField, TokenEndOfEntry, TokenEOF,
+	}, kinds)
+	assert.Equal(t, []string{
+		"[2021/09/23 14:25:14.123 +08:00]", "[INFO]", "[main.go:10]", "[msg]",
+		"[k=v]", `["a b"="c"]`, "", "",
+	}, raws)
+}
+
+func TestStreamParser_NextTokenValues(t *testing.T) {
+	parser := NewStreamParser(strings.NewReader("[2021/09/23 14:25:14.123 +08:00] [WARN] [a/b.go:7] [\"hi\"] [k=v]\nmore\n"), WithAttachContinuations(true))
+	tok, err := parser.NextToken()
+	assert.NoError(t, err)
+	assert.Equal(t, 2021, tok.DateTime.Year())
+	tok, err = parser.NextToken()
+	assert.NoError(t, err)
+	assert.Equal(t, LogLevelWarn, tok.Level)
+	tok, err = parser.NextToken()
+	assert.NoError(t, err)
+	assert.Equal(t, "a/b.go", tok.File)
+	assert.Equal(t, 7, tok.Line)
+	tok, err = parser.NextToken()
+	assert.NoError(t, err)
+	assert.Equal(t, "hi", tok.Text)
+	tok, err = parser.NextToken()
+	assert.NoError(t, err)
+	assert.Equal(t, LogField{Name: "k", Value: "v"}, tok.Field)
+	tok, err = parser.NextToken()
+	assert.NoError(t, err)
+	assert.Equal(t, TokenContinuation, tok.Kind)
+	assert.Equal(t, "more", tok.Text)
+	tok, err = parser.NextToken()
+	assert.NoError(t, err)
+	assert.Equal(t, TokenEndOfEntry, tok.Kind)
+}
+
+func TestStreamParser_NextTokenRecover(t *testing.T) {
+	parser := NewStreamParser(strings.NewReader("[2021/09/23 14:25:14.123 +08:00] [BAD] [a.go:1] [m]\n[2021/09/23 14:25:14.123 +08:00] [INFO] [a.go:1] [m]\n"))
+	_, err := parser.NextToken()
+	assert.NoError(t, err)
+	_, err = parser.NextToken()
+	assert.Error(t, err)
+	// The tokenizer starts over from a new entry.
+	err = parser.SkipLines(1)
+	assert.NoError(t, err)
+	entry, err := parser.ParseNext()
+	assert.NoError(t, err)
+	assert.Equal(t, LogLevelInfo, entry.Header.Level)
+}
+
+func TestStreamParser_NextTokenSource(t *testing.T) {
+	parser := NewStreamParser(strings.NewReader(`host01 tikv: [2021/09/23 14:25:14.123 +08:00] [INFO] [main.go:10] [msg]`), WithLinePrefix(regexp.MustCompile(`^\S+ \S+: `)))
+	tok, err := parser.NextToken()
+	assert.NoError(t, err)
+	assert.Equal(t, TokenSource, tok.Kind)
+	assert.Equal(t, "host01 tikv:", tok.Text)
+	assert.Equal(t, "host01 tikv: ", tok.Raw)
+	tok, err = parser.NextToken()
+	assert.NoError(t, err)
+	assert.Equal(t, TokenDatetime, tok.Kind)
+	assert.Equal(t, "[2021/09/23 14:25:14.123 +08:00]", tok.Raw)
+}
+
+func TestStreamParser_NextTokenComment(t *testing.T) {
+	parser := NewStreamParser(strings.NewReader("[2021/09/23 14:25:14.123 +08:00] [INFO] [main.go:10] [msg] [k=v] # note\n"), WithTrailingComment("#"))
+	var kinds []TokenKind
+	for {
+		tok, err := parser.NextToken()
+		assert.NoError(t, err)
+		kinds = append(kinds, tok.Kind)
+		if tok.Kind == TokenComment {
+			assert.Equal(t, "note", tok.Text)
+			assert.Equal(t, "# note", tok.Raw)
+		}
+		if tok.Kind == TokenEOF {
+			break
+		}
+	}
+	assert.Equal(t, []TokenKind{
+		TokenDatetime, TokenLevel, TokenFileLine, TokenMessage,
+		TokenField, TokenComment, TokenEndOfEntry, TokenEOF,
+	}, kinds)
+}